@@ -1,9 +1,15 @@
 package main
 
 import (
+	"os"
+
 	kafkalayer "github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/app"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/cli"
 )
 
 func main() {
+	if cli.IsCommand(os.Args[1:]) {
+		os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
 	kafkalayer.Wire().Run()
 }
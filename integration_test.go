@@ -167,7 +167,7 @@ func TestLayer(t *testing.T) {
 					"ns0:phones[0].type":"HOME",
 					"ns0:phones[1].number":"555-100-300",
 					"ns0:phones[1].type":"WORK"},
-					"refs":{"ns0:houseNumberRef":"http://data.example.com/houses/601"}}
+					"refs":{"ns0:houseNumberRef":"http://data.example.com/houses/601","rdf:type":["http://data.example.com/persons/person","http://data.example.com/persons/address"]}}
 				,{"id":"@continuation","token":"eyIwIjowfQ=="}
 				]`), &expected)
 			g.Assert(entities).Eql(expected)
@@ -185,7 +185,7 @@ func TestLayer(t *testing.T) {
 
 			var expected []map[string]interface{}
 			json.Unmarshal([]byte(`[{"id":"@context","namespaces":{"ns0":"http://data.example.com/pets/pet/","rdf":"http://www.w3.org/1999/02/22-rdf-syntax-ns#"}}
-                ,{"id":"http://data.example.com/pets/animal/Bob","deleted":true,"props":{"ns0:age":3,"ns0:kind":"Cat","ns0:name":"Bob"}}
+                ,{"id":"http://data.example.com/pets/animal/Bob","deleted":true,"refs":{"rdf:type":"http://data.example.com/pets/animal"},"props":{"ns0:age":3,"ns0:kind":"Cat","ns0:name":"Bob"}}
                 ,{"id":"@continuation","token":"eyIwIjowfQ=="}
             ]`), &expected)
 			g.Assert(entities).Eql(expected)
@@ -196,7 +196,7 @@ func TestLayer(t *testing.T) {
 			g.Assert(err).IsNil()
 			g.Assert(resp.StatusCode).Eql(200)
 			bodyBytes, _ := io.ReadAll(resp.Body)
-			g.Assert(len(bodyBytes)).Eql(217993, "no limit or since parameters should yield all 11000 entities")
+			g.Assert(len(bodyBytes)).Eql(270793, "no limit or since parameters should yield all 11000 entities")
 		})
 
 		g.It("Should expose json dataset with limit", func() {
@@ -212,9 +212,9 @@ func TestLayer(t *testing.T) {
 
 			var expected []map[string]interface{}
 			json.Unmarshal([]byte(`[{"id":"@context","namespaces":{"ns0":"http://data.example.com/cities/places/","rdf":"http://www.w3.org/1999/02/22-rdf-syntax-ns#"}}
-        ,{"id":"http://data.example.com/cities/city/City-0","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/3000"},"props":{"ns0:name":"City-0","ns0:postCode":3000}}
-        ,{"id":"http://data.example.com/cities/city/City-5","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/3005"},"props":{"ns0:name":"City-5","ns0:postCode":3005}}
-        ,{"id":"http://data.example.com/cities/city/City-6","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/3006"},"props":{"ns0:name":"City-6","ns0:postCode":3006}}
+        ,{"id":"http://data.example.com/cities/city/City-0","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/3000","rdf:type":"http://data.example.com/place/city"},"props":{"ns0:name":"City-0","ns0:postCode":3000}}
+        ,{"id":"http://data.example.com/cities/city/City-5","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/3005","rdf:type":"http://data.example.com/place/city"},"props":{"ns0:name":"City-5","ns0:postCode":3005}}
+        ,{"id":"http://data.example.com/cities/city/City-6","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/3006","rdf:type":"http://data.example.com/place/city"},"props":{"ns0:name":"City-6","ns0:postCode":3006}}
         ,{"id":"@continuation","token":"eyIwIjoyfQ=="}
         ]`), &expected)
 			g.Assert(entities).Eql(expected)
@@ -235,9 +235,9 @@ func TestLayer(t *testing.T) {
 
 			var expected []map[string]interface{}
 			json.Unmarshal([]byte(`[{"id":"@context","namespaces":{"ns0":"http://data.example.com/cities/places/","rdf":"http://www.w3.org/1999/02/22-rdf-syntax-ns#"}}
-        ,{"id":"http://data.example.com/cities/city/City-1091","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/4091"},"props":{"ns0:name":"City-1091","ns0:postCode":4091}}
-        ,{"id":"http://data.example.com/cities/city/City-1092","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/4092"},"props":{"ns0:name":"City-1092","ns0:postCode":4092}}
-        ,{"id":"http://data.example.com/cities/city/City-1098","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/4098"},"props":{"ns0:name":"City-1098","ns0:postCode":4098}}
+        ,{"id":"http://data.example.com/cities/city/City-1091","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/4091","rdf:type":"http://data.example.com/place/city"},"props":{"ns0:name":"City-1091","ns0:postCode":4091}}
+        ,{"id":"http://data.example.com/cities/city/City-1092","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/4092","rdf:type":"http://data.example.com/place/city"},"props":{"ns0:name":"City-1092","ns0:postCode":4092}}
+        ,{"id":"http://data.example.com/cities/city/City-1098","deleted":false,"refs":{"ns0:postCodeRef":"http://data.example.com/cities/post-code/4098","rdf:type":"http://data.example.com/place/city"},"props":{"ns0:name":"City-1098","ns0:postCode":4098}}
         ,{"id":"@continuation","token":"eyIwIjozMDEsIjEiOjI5NSwiMiI6MjUwLCIzIjoyNTB9"}
         ]`), &expected)
 			g.Assert(entities).Eql(expected)
@@ -9,9 +9,12 @@ import (
 )
 
 func Wire() *fx.App {
+	// the env is read up front, as it decides how long the app may take to stop
+	env := conf.NewEnv()
 	return fx.New(
+		fx.Supply(env),
+		fx.StopTimeout(env.ShutdownTimeout),
 		fx.Provide(
-			conf.NewEnv,
 			conf.NewLogger,
 			conf.NewStatsd,
 			security.NewTokenProviders,
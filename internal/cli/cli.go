@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+const usage = `usage: kafkalayer [command] [flags]
+
+commands:
+  server     run the data layer (default)
+  validate   validate a config file
+             --config file.json [--check-registry]
+  map        run a consumer dataset mapping against sample messages and print the entities
+             --config file.json --dataset name --input file [--input file ...]
+             [--avro-schema file.avsc] [--envelope]
+`
+
+// IsCommand reports whether the arguments select an offline command instead of the server.
+func IsCommand(args []string) bool {
+	return len(args) > 0 && args[0] != "server"
+}
+
+// Run executes an offline command and returns the process exit code.
+func Run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		_, _ = fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "validate":
+		err = validate(args[1:], stdout)
+	case "map":
+		err = mapMessages(args[1:], stdout, stderr)
+	case "help", "-h", "--help":
+		_, _ = fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		_, _ = fmt.Fprintf(stderr, "unknown command %q\n%s", args[0], usage)
+		return 2
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func validate(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := fs.String("config", "", "config file to validate")
+	checkRegistry := fs.Bool("check-registry", false, "fail if a configured schema registry cannot be reached")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	err = config.Validate(conf.ValidationOptions{
+		CheckSchemaRegistry: *checkRegistry,
+		Warn: func(e conf.ValidationError) {
+			_, _ = fmt.Fprintln(stdout, "warning: "+e.Error())
+		},
+	})
+	if errs, ok := err.(conf.ValidationErrors); ok {
+		for _, e := range errs {
+			_, _ = fmt.Fprintln(stdout, e.Error())
+		}
+		return fmt.Errorf("%s is invalid, %d problem(s) found", *configFile, len(errs))
+	}
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(stdout, "%s is valid\n", *configFile)
+	return nil
+}
+
+type inputs []string
+
+func (i *inputs) String() string {
+	return fmt.Sprint(*i)
+}
+
+func (i *inputs) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+// envelope is the line format used with --envelope, to give json messages a key and headers.
+type envelope struct {
+	Key     *string           `json:"key"`
+	Value   json.RawMessage   `json:"value"`
+	Headers map[string]string `json:"headers"`
+}
+
+func mapMessages(args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("map", flag.ContinueOnError)
+	configFile := fs.String("config", "", "config file containing the dataset")
+	datasetName := fs.String("dataset", "", "consumer dataset to map with")
+	avroSchema := fs.String("avro-schema", "", "avro schema file used instead of the schema registry")
+	useEnvelope := fs.Bool("envelope", false, "json lines are {\"key\": ..., \"value\": ..., \"headers\": {...}} objects")
+	var files inputs
+	fs.Var(&files, "input", "input file, json lines for json datasets or one binary message per file (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	files = append(files, fs.Args()...)
+	if len(files) == 0 {
+		return errors.New("at least one --input is required")
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	// the encoder expects a validated config, like the server only activates valid ones
+	err = config.Validate(conf.ValidationOptions{
+		Warn: func(e conf.ValidationError) {
+			_, _ = fmt.Fprintln(stderr, "warning: "+e.Error())
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s is invalid: %w", *configFile, err)
+	}
+	var consumerConfig *conf.ConsumerConfig
+	for i := range config.Consumers {
+		if config.Consumers[i].Dataset == *datasetName {
+			consumerConfig = &config.Consumers[i]
+		}
+	}
+	if consumerConfig == nil {
+		return fmt.Errorf("no consumer dataset %q in %s", *datasetName, *configFile)
+	}
+
+	decoder, err := newDecoder(consumerConfig, *avroSchema)
+	if err != nil {
+		return err
+	}
+	binaryInput := consumerConfig.ValueDecoder != nil && *consumerConfig.ValueDecoder != "json"
+
+	messages := make([]*kafka.Message, 0)
+	for _, file := range files {
+		msgs, err := readMessages(file, binaryInput, *useEnvelope)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, msgs...)
+	}
+
+	encoder := coder.NewEntityEncoder(consumerConfig)
+	result := []interface{}{coder.DatasetContext(consumerConfig)}
+	for _, msg := range messages {
+		var value []byte
+		if msg.Value != nil {
+			// tombstones have no value to decode, and are encoded as deleted entities
+			value, err = decoder.Decode(msg)
+			if err != nil {
+				return fmt.Errorf("could not decode message %s: %w", msg.TopicPartition, err)
+			}
+		}
+		entity, err := encoder.EncodeMessage(msg, value)
+		if err != nil {
+			return fmt.Errorf("could not map message %s: %w", msg.TopicPartition, err)
+		}
+		if entity != nil {
+			result = append(result, entity)
+		}
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, string(out))
+	return err
+}
+
+func loadConfig(file string) (*conf.KafkaConfig, error) {
+	if file == "" {
+		return nil, errors.New("--config is required")
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return conf.Parse(content)
+}
+
+func newDecoder(config *conf.ConsumerConfig, avroSchema string) (coder.Decoder, error) {
+	if config.ValueDecoder != nil && *config.ValueDecoder == "avro" {
+		if avroSchema == "" {
+			return nil, errors.New("avro datasets need a local --avro-schema file")
+		}
+		schema, err := os.ReadFile(avroSchema)
+		if err != nil {
+			return nil, err
+		}
+		return coder.NewLocalAvroDecoder(string(schema))
+	}
+	return coder.NewDecoder(config)
+}
+
+// readMessages reads a binary input file as a single message, and a json lines file as one message per line.
+// Messages get the file name as topic and their line number as offset, to make errors traceable.
+func readMessages(file string, binaryInput bool, useEnvelope bool) ([]*kafka.Message, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	topic := file
+	if binaryInput {
+		return []*kafka.Message{{
+			TopicPartition: kafka.TopicPartition{Topic: &topic},
+			Value:          content,
+		}}, nil
+	}
+
+	messages := make([]*kafka.Message, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: kafka.Offset(line)},
+			Value:          append([]byte(nil), raw...),
+		}
+		if useEnvelope {
+			env := &envelope{}
+			if err := json.Unmarshal(raw, env); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+			}
+			msg.Value = env.Value
+			if bytes.Equal(env.Value, []byte("null")) {
+				// a null value is a tombstone, like a missing one
+				msg.Value = nil
+			}
+			if env.Key != nil {
+				msg.Key = []byte(*env.Key)
+			}
+			for k, v := range env.Headers {
+				msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+			}
+		}
+		messages = append(messages, msg)
+	}
+	return messages, scanner.Err()
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func testConfig(t *testing.T) (string, string) {
+	resourcesTestPath := "../../resources/test"
+	overridePath := os.Getenv("RESOURCES_TEST_DIR")
+	if overridePath != "" {
+		resourcesTestPath = overridePath
+	}
+	input, err := os.ReadFile(path.Join(resourcesTestPath, "/test-config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := bytes.ReplaceAll(input, []byte("RESOURCEPATH"), []byte(resourcesTestPath))
+	configFile := path.Join(t.TempDir(), "config.json")
+	if err = os.WriteFile(configFile, output, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return resourcesTestPath, configFile
+}
+
+func TestValidate(t *testing.T) {
+	_, configFile := testConfig(t)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	if code := Run([]string{"validate", "--config", configFile}, stdout, stderr); code != 0 {
+		t.Errorf("expected valid config, got %d: %s %s", code, stdout, stderr)
+	}
+
+	broken := path.Join(t.TempDir(), "broken.json")
+	_ = os.WriteFile(broken, []byte(`{"consumers": [{"dataset": "a", "topic": "t", "groupId": "g", "valueDecoder": "xml"}]}`), 0666)
+	stdout.Reset()
+	if code := Run([]string{"validate", "--config", broken}, stdout, stderr); code != 1 {
+		t.Errorf("expected invalid config, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), "consumers[0].valueDecoder") {
+		t.Errorf("expected problem path in output, got %s", stdout)
+	}
+
+	lenient := path.Join(t.TempDir(), "lenient.json")
+	_ = os.WriteFile(lenient, []byte(`{"consumers": [{"dataset": "a", "topic": "t"}]}`), 0666)
+	stdout.Reset()
+	if code := Run([]string{"validate", "--config", lenient}, stdout, stderr); code != 0 {
+		t.Errorf("expected a config without groupId to be valid, got %d: %s", code, stdout)
+	}
+	if !strings.Contains(stdout.String(), "warning: consumers[0].groupId") {
+		t.Errorf("expected a warning in output, got %s", stdout)
+	}
+}
+
+func TestMap(t *testing.T) {
+	resourcesTestPath, configFile := testConfig(t)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := Run([]string{"map", "--config", configFile, "--dataset", "proto-consumer-ds",
+		"--input", path.Join(resourcesTestPath, "/protobuf-wire-person")}, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("map failed with %d: %s", code, stderr)
+	}
+	var entities []map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &entities); err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 2 || entities[1]["id"] != "http://data.example.com/persons/person/test" {
+		t.Errorf("unexpected entities: %s", stdout)
+	}
+
+	input := path.Join(t.TempDir(), "messages.jsonl")
+	_ = os.WriteFile(input, []byte(`{"key": "k1", "value": {"name": "Oslo", "postCode": 150}}
+{"key": "k2", "value": {"name": "Bergen", "postCode": 5003}}
+{"key": "Trondheim", "value": null}
+`), 0666)
+	stdout.Reset()
+	code = Run([]string{"map", "--config", configFile, "--dataset", "json-consumer-ds", "--envelope", input}, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("map failed with %d: %s", code, stderr)
+	}
+	entities = nil
+	if err := json.Unmarshal(stdout.Bytes(), &entities); err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 4 || entities[2]["id"] != "http://data.example.com/cities/city/Bergen" {
+		t.Fatalf("unexpected entities: %s", stdout)
+	}
+	if entities[3]["id"] != "http://data.example.com/cities/city/Trondheim" || entities[3]["deleted"] != true {
+		t.Errorf("expected a null value to be a tombstone, got %v", entities[3])
+	}
+
+	broken := path.Join(t.TempDir(), "broken.json")
+	_ = os.WriteFile(broken, []byte(`{"consumers": [{"dataset": "a", "topic": "t", "groupId": "g", "idTemplate": "{name"}]}`), 0666)
+	stdout.Reset()
+	stderr.Reset()
+	if code = Run([]string{"map", "--config", broken, "--dataset", "a", input}, stdout, stderr); code != 1 {
+		t.Errorf("expected map to fail on an invalid config, got %d: %s", code, stdout)
+	}
+	if !strings.Contains(stderr.String(), "consumers[0].idTemplate") {
+		t.Errorf("expected the problem in the output, got %s", stderr)
+	}
+}
@@ -0,0 +1,212 @@
+package coder
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/tidwall/gjson"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// conversion applies the transforms and the datatype of a field mapping to mapped values.
+type conversion struct {
+	transforms     []*conf.Transform
+	patterns       []*regexp.Regexp
+	datatype       string
+	datetimeFormat string
+}
+
+// newConversion returns nil for mappings that copy values as is. Configs are validated before they are
+// used, so patterns that do not compile are not expected here, and are skipped.
+func newConversion(mapping *conf.FieldMapping) *conversion {
+	if len(mapping.Transforms) == 0 && mapping.Datatype == "" {
+		return nil
+	}
+	c := &conversion{
+		transforms:     mapping.Transforms,
+		patterns:       make([]*regexp.Regexp, len(mapping.Transforms)),
+		datatype:       mapping.Datatype,
+		datetimeFormat: mapping.DatetimeFormat,
+	}
+	for i, t := range mapping.Transforms {
+		if t.Type == conf.TransformReplace {
+			c.patterns[i], _ = regexp.Compile(t.Pattern)
+		}
+	}
+	return c
+}
+
+// hasDefault tells if missing values get a default value.
+func (c *conversion) hasDefault() bool {
+	for _, t := range c.transforms {
+		if t.Type == conf.TransformDefault {
+			return true
+		}
+	}
+	return false
+}
+
+// apply converts the value, or each element if it is an array. A missing value is nil, and stays nil
+// unless a default is given.
+func (c *conversion) apply(value gjson.Result) (interface{}, error) {
+	var v interface{}
+	if value.Exists() {
+		v = value.Value()
+	}
+	if list, ok := v.([]interface{}); ok {
+		result := make([]interface{}, len(list))
+		for i, item := range list {
+			converted, err := c.convert(item)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			result[i] = converted
+		}
+		return result, nil
+	}
+	return c.convert(v)
+}
+
+func (c *conversion) convert(v interface{}) (interface{}, error) {
+	for i, t := range c.transforms {
+		switch t.Type {
+		case conf.TransformLowercase:
+			if s, ok := v.(string); ok {
+				v = strings.ToLower(s)
+			}
+		case conf.TransformUppercase:
+			if s, ok := v.(string); ok {
+				v = strings.ToUpper(s)
+			}
+		case conf.TransformTrim:
+			if s, ok := v.(string); ok {
+				v = strings.TrimSpace(s)
+			}
+		case conf.TransformReplace:
+			if s, ok := v.(string); ok && c.patterns[i] != nil {
+				v = c.patterns[i].ReplaceAllString(s, t.Replacement)
+			}
+		case conf.TransformDefault:
+			if v == nil {
+				v = t.Value
+			}
+		case conf.TransformMap:
+			if s, ok := scalarString(v); ok {
+				if mapped, found := t.Values[s]; found {
+					v = mapped
+				}
+			}
+		}
+	}
+	if v == nil {
+		return nil, nil
+	}
+	return c.coerce(v)
+}
+
+func (c *conversion) coerce(v interface{}) (interface{}, error) {
+	switch c.datatype {
+	case conf.DatatypeString:
+		if s, ok := scalarString(v); ok {
+			return s, nil
+		}
+	case conf.DatatypeInt:
+		switch val := v.(type) {
+		case float64:
+			if val == math.Trunc(val) {
+				return int64(val), nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64); err == nil {
+				return i, nil
+			}
+		}
+	case conf.DatatypeFloat:
+		switch val := v.(type) {
+		case float64:
+			return val, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+				return f, nil
+			}
+		}
+	case conf.DatatypeBool:
+		switch val := v.(type) {
+		case bool:
+			return val, nil
+		case float64:
+			if val == 0 || val == 1 {
+				return val == 1, nil
+			}
+		case string:
+			switch strings.ToLower(strings.TrimSpace(val)) {
+			case "true", "t", "1", "yes", "y":
+				return true, nil
+			case "false", "f", "0", "no", "n":
+				return false, nil
+			}
+		}
+	case conf.DatatypeDatetime:
+		if t, ok := c.datetime(v); ok {
+			return t.UTC().Format(time.RFC3339Nano), nil
+		}
+	case conf.DatatypeUUID:
+		if s, ok := v.(string); ok {
+			if raw, err := uuid.ParseUUID(strings.ToLower(strings.TrimSpace(s))); err == nil {
+				return uuid.FormatUUID(raw)
+			}
+		}
+	default:
+		return v, nil
+	}
+	return nil, fmt.Errorf("%v can not be converted to %s", v, c.datatype)
+}
+
+// datetime parses strings with the datetimeFormat layout, RFC3339 by default, and numbers as epoch millis,
+// or seconds if the format is epochSeconds.
+func (c *conversion) datetime(v interface{}) (time.Time, bool) {
+	switch val := v.(type) {
+	case float64:
+		if c.datetimeFormat == conf.DatetimeEpochSeconds {
+			return time.UnixMilli(int64(val * 1000)), true
+		}
+		return time.UnixMilli(int64(val)), true
+	case string:
+		switch c.datetimeFormat {
+		case conf.DatetimeEpochMillis, conf.DatetimeEpochSeconds:
+			f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return c.datetime(f)
+		}
+		layout := c.datetimeFormat
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, val)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// scalarString formats strings, numbers and bools the way they are written in json.
+func scalarString(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(val, 10), true
+	case bool:
+		return strconv.FormatBool(val), true
+	}
+	return "", false
+}
@@ -3,11 +3,12 @@ package coder
 import (
 	"encoding/binary"
 	"fmt"
+	"sync"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/jhump/protoreflect/desc"
-	"github.com/jhump/protoreflect/desc/protoparse"
 	"github.com/jhump/protoreflect/dynamic"
+	"github.com/linkedin/goavro/v2"
 	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
 	"github.com/riferrei/srclient"
 )
@@ -23,7 +24,7 @@ func NewDecoder(config *conf.ConsumerConfig) (Decoder, error) {
 			var schemaRegistryClient *srclient.SchemaRegistryClient
 			if config.SchemaRegistry != nil && config.SchemaRegistry.Location != "" {
 				schemaRegistryClient = srclient.CreateSchemaRegistryClient(config.SchemaRegistry.Location)
-				return AvroDecoder{
+				return &AvroDecoder{
 					client: schemaRegistryClient,
 					cache:  make(map[uint32]*srclient.Schema),
 				}, nil
@@ -35,7 +36,7 @@ func NewDecoder(config *conf.ConsumerConfig) (Decoder, error) {
 				config.ProtobufSchema.FileName != "" &&
 				config.ProtobufSchema.Type != "" &&
 				config.ProtobufSchema.Path != "" {
-				md, err := loadMessageDescriptor(config.ProtobufSchema)
+				md, err := config.ProtobufSchema.Load()
 				if err != nil {
 					return nil, err
 
@@ -55,49 +56,75 @@ func (decoder DefaultDecoder) Decode(msg *kafka.Message) ([]byte, error) {
 	return msg.Value, nil
 }
 
+// AvroDecoder is shared by all reads of a dataset, so the schema cache is guarded by a lock.
 type AvroDecoder struct {
 	client *srclient.SchemaRegistryClient
 	cache  map[uint32]*srclient.Schema
+	lock   sync.Mutex
 }
 
-func (decoder AvroDecoder) Decode(msg *kafka.Message) ([]byte, error) {
+func (decoder *AvroDecoder) Decode(msg *kafka.Message) ([]byte, error) {
+	if len(msg.Value) < 5 || msg.Value[0] != 0 {
+		return nil, fmt.Errorf("value of %d bytes is not in the schema registry wire format", len(msg.Value))
+	}
 	schemaID := binary.BigEndian.Uint32(msg.Value[1:5])
 
-	var schema *srclient.Schema
-	if s, ok := decoder.cache[schemaID]; ok {
-		schema = s
-	} else {
-		s, err := decoder.client.GetSchema(int(schemaID))
-		if err != nil {
-			return nil, err
-		}
-		decoder.cache[schemaID] = s
-		schema = s
+	schema, err := decoder.schema(schemaID)
+	if err != nil {
+		return nil, err
 	}
 
-	native, _, _ := schema.Codec().NativeFromBinary(msg.Value[5:])
+	native, _, err := schema.Codec().NativeFromBinary(msg.Value[5:])
+	if err != nil {
+		return nil, err
+	}
 	return schema.Codec().TextualFromNative(nil, native)
 }
 
-type GenericProtoDecoder struct {
-	messageDescriptor *desc.MessageDescriptor
+func (decoder *AvroDecoder) schema(schemaID uint32) (*srclient.Schema, error) {
+	decoder.lock.Lock()
+	defer decoder.lock.Unlock()
+	if s, ok := decoder.cache[schemaID]; ok {
+		return s, nil
+	}
+	s, err := decoder.client.GetSchema(int(schemaID))
+	if err != nil {
+		return nil, err
+	}
+	decoder.cache[schemaID] = s
+	return s, nil
 }
 
-func loadMessageDescriptor(protobufSchemaConf *conf.ProtobufSchema) (*desc.MessageDescriptor, error) {
+// LocalAvroDecoder decodes avro messages with a schema given up front, instead of looking it up in a
+// schema registry. Messages in confluent wire format are detected and their header skipped.
+type LocalAvroDecoder struct {
+	codec *goavro.Codec
+}
 
-	var protoParser protoparse.Parser
-	//TODO: set protoParser.Accessor instead of importpaths - a function that can produce io.Readers from ConsumerConfig.
-	protoParser.ImportPaths = append(protoParser.ImportPaths, protobufSchemaConf.Path)
-	fds, err := protoParser.ParseFiles(protobufSchemaConf.FileName)
+func NewLocalAvroDecoder(schema string) (*LocalAvroDecoder, error) {
+	codec, err := goavro.NewCodec(schema)
 	if err != nil {
 		return nil, err
 	}
-	fd := fds[0]
-	//for _, x := range fd.GetMessageTypes() {
-	//	fmt.Printf("%+v\n", x)
-	//}
-	messageDescriptor := fd.FindMessage(protobufSchemaConf.Type)
-	return messageDescriptor, nil
+	return &LocalAvroDecoder{codec: codec}, nil
+}
+
+func (decoder *LocalAvroDecoder) Decode(msg *kafka.Message) ([]byte, error) {
+	native, rest, err := decoder.codec.NativeFromBinary(msg.Value)
+	if (err != nil || len(rest) > 0) && len(msg.Value) > 5 && msg.Value[0] == 0 {
+		native, rest, err = decoder.codec.NativeFromBinary(msg.Value[5:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after avro record", len(rest))
+	}
+	return decoder.codec.TextualFromNative(nil, native)
+}
+
+type GenericProtoDecoder struct {
+	messageDescriptor *desc.MessageDescriptor
 }
 
 func (decoder GenericProtoDecoder) Decode(msg *kafka.Message) ([]byte, error) {
@@ -9,6 +9,7 @@ import (
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/franela/goblin"
 	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+	"github.com/riferrei/srclient"
 )
 
 func TestDecoder(t *testing.T) {
@@ -60,4 +61,26 @@ func TestDecoder(t *testing.T) {
 			g.Assert(resMap).Eql(expected)
 		})
 	})
+	g.Describe("An avro Decoder", func() {
+		schema, _ := srclient.NewSchema(1, `{"type": "record", "name": "person", "fields": [{"name": "age", "type": "long"}]}`,
+			srclient.Avro, 1, nil, nil, nil)
+		// the schema is cached, so the registry client is never used
+		dec := &AvroDecoder{cache: map[uint32]*srclient.Schema{1: schema}}
+
+		g.It("should decode values in the schema registry wire format", func() {
+			result, err := dec.Decode(&kafka.Message{Value: []byte{0, 0, 0, 0, 1, 6}})
+			g.Assert(err).IsNil()
+			g.Assert(string(result)).Eql(`{"age":3}`)
+		})
+		g.It("should fail on values that are too short or have no magic byte", func() {
+			_, err := dec.Decode(&kafka.Message{Value: []byte{0, 0, 1}})
+			g.Assert(err == nil).IsFalse("expected an error for a short value")
+			_, err = dec.Decode(&kafka.Message{Value: []byte(`{"age": 3}`)})
+			g.Assert(err == nil).IsFalse("expected an error for a value without magic byte")
+		})
+		g.It("should fail on values that do not match the schema", func() {
+			_, err := dec.Decode(&kafka.Message{Value: []byte{0, 0, 0, 0, 1}})
+			g.Assert(err == nil).IsFalse("expected an error for a value without data")
+		})
+	})
 }
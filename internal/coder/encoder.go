@@ -2,7 +2,10 @@ package coder
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
@@ -11,48 +14,174 @@ import (
 	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
 )
 
+const RdfType = "rdf:type"
+
 type EntityEncoder struct {
-	config  *conf.ConsumerConfig
-	columns map[string]*conf.FieldMapping
+	config      *conf.ConsumerConfig
+	columns     map[string]*conf.FieldMapping
+	conversions map[*conf.FieldMapping]*conversion
+	idTemplate  *conf.IdTemplate
+	idMapped    bool
+	prefixes    map[string]string
+}
+
+// encoding is the state of encoding a single message.
+type encoding struct {
+	key  string
+	errs []error
 }
 
 func NewEntityEncoder(config *conf.ConsumerConfig) EntityEncoder {
 	columns := make(map[string]*conf.FieldMapping)
+	conversions := make(map[*conf.FieldMapping]*conversion)
+	idMapped := false
 	for _, m := range config.FieldMappings {
 		columns[m.FieldName] = m
+		if c := newConversion(m); c != nil {
+			conversions[m] = c
+		}
+		idMapped = idMapped || m.IsIdField
 	}
 
-	return EntityEncoder{config: config, columns: columns}
+	// configs are validated before they are used, so an invalid template is not expected here
+	idTemplate, _ := conf.ParseIdTemplate(config.IdTemplate)
+	if config.IdTemplate == "" {
+		idTemplate = nil
+	}
+	return EntityEncoder{
+		config:      config,
+		columns:     columns,
+		conversions: conversions,
+		idTemplate:  idTemplate,
+		idMapped:    idMapped || idTemplate != nil,
+		prefixes:    nestedPrefixes(config),
+	}
 }
 
-func (encoder EntityEncoder) Encode(kkey []byte, data []byte) *Entity {
-	entity := NewEntity()
+// nestedPrefixes gives the namespace prefix of each field path in nestedNameSpaces. Prefixes are numbered after
+// ns0 in the order of the field paths.
+func nestedPrefixes(config *conf.ConsumerConfig) map[string]string {
+	paths := make([]string, 0, len(config.NestedNameSpaces))
+	for p := range config.NestedNameSpaces {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	prefixes := make(map[string]string, len(paths))
+	for i, p := range paths {
+		prefixes[p] = fmt.Sprintf("ns%d", i+1)
+	}
+	return prefixes
+}
 
-	js := string(data)
-	key := string(kkey)
+// DatasetContext returns the @context object of a consumer dataset.
+func DatasetContext(config *conf.ConsumerConfig) map[string]interface{} {
+	ctx := make(map[string]interface{})
+	namespaces := make(map[string]string)
 
-	// we need to convert the json into a map, so we can loop the fields
-	items := make(map[string]interface{})
-	_ = json.Unmarshal(data, &items)
+	namespaces["ns0"] = config.BaseNameSpace + config.NameSpace + "/"
+	namespaces["rdf"] = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	for p, prefix := range nestedPrefixes(config) {
+		namespaces[prefix] = config.BaseNameSpace + config.NestedNameSpaces[p] + "/"
+	}
+	ctx["namespaces"] = namespaces
+	ctx["id"] = "@context"
+	return ctx
+}
 
-	for k, v := range items {
-		encoder.flatten("", k, v, js, entity, key)
+// EncodeMessage encodes the decoded value of the message, including its headers if the dataset is configured
+// to do so. It returns nil for tombstones without key, and if the entity id can not be built and the dataset
+// skips such messages. Values that field mappings can not transform or convert fail the message, unless the
+// dataset drops such fields.
+func (encoder EntityEncoder) EncodeMessage(msg *kafka.Message, value []byte) (*Entity, error) {
+	state := &encoding{key: string(msg.Key)}
+	entity := encoder.encode(msg, value, state)
+	if entity != nil && encoder.config.IncludeHeaders {
+		encoder.addHeaders(entity, msg.Headers, state)
 	}
+	if len(state.errs) > 0 {
+		return nil, fmt.Errorf("could not map message: %w", errors.Join(state.errs...))
+	}
+	return entity, nil
+}
 
-	return entity
+// Encode maps the decoded message value to an entity. A nil value is a tombstone, and becomes a deleted
+// entity with the id built from the message key, or nil if it has no key. Id templates only see the key, use EncodeMessage to
+// also give them the headers, partition and offset. Values that can not be converted are left out.
+func (encoder EntityEncoder) Encode(kkey []byte, data []byte) *Entity {
+	return encoder.encode(&kafka.Message{Key: kkey}, data, &encoding{key: string(kkey)})
 }
-func (encoder EntityEncoder) EncodeWithHeaders(kkey []byte, data []byte, kafkaHeaders []kafka.Header) *Entity {
+
+func (encoder EntityEncoder) encode(msg *kafka.Message, data []byte, state *encoding) *Entity {
 	entity := NewEntity()
+	js := ""
+	if data == nil {
+		entity.IsDeleted = true
+	} else {
+		js = string(data)
 
-	js := string(data)
-	key := string(kkey)
+		// we need to convert the json into a map, so we can loop the fields
+		items := make(map[string]interface{})
+		_ = json.Unmarshal(data, &items)
 
-	// we need to convert the json into a map, so we can loop the fields
-	items := make(map[string]interface{})
-	_ = json.Unmarshal(data, &items)
-	for k, v := range items {
-		encoder.flatten("", k, v, js, entity, key)
+		nesting := encoder.config.Nesting == conf.NestingEntities
+		for k, v := range items {
+			if nesting {
+				encoder.nest("", k, v, js, entity, entity, state)
+			} else {
+				encoder.flatten("", k, v, js, entity, state)
+			}
+		}
+		if len(items) > 0 {
+			encoder.addTypes(js, entity)
+			encoder.addDefaults(js, entity, state)
+		}
+	}
+	if encoder.idTemplate != nil {
+		entity.ID = encoder.templateId(msg, js)
+	}
+
+	if entity.ID == "" && data == nil {
+		// tombstones are identified by their key whatever the idMissing policy, and would not delete anything
+		// without one
+		entity.ID = encoder.keyId(msg.Key)
+		if entity.ID == "" {
+			return nil
+		}
+	}
+	if entity.ID == "" && encoder.idMapped {
+		switch encoder.config.IdMissing {
+		case conf.IdMissingSkip:
+			return nil
+		case conf.IdMissingPartitionOffset:
+			entity.ID = encoder.config.BaseNameSpace +
+				fmt.Sprintf("%d-%d", msg.TopicPartition.Partition, int64(msg.TopicPartition.Offset))
+		case conf.IdMissingKafkaKey:
+			entity.ID = encoder.keyId(msg.Key)
+		}
+		if entity.ID == "" {
+			// skipped by default, an entity without id can not be told apart from the others
+			return nil
+		}
 	}
+	if entity.ID != "" {
+		nestedIds(entity)
+	}
+	return entity
+}
+
+// EncodeWithHeaders is Encode, with the headers added as kafka_header props.
+func (encoder EntityEncoder) EncodeWithHeaders(kkey []byte, data []byte, kafkaHeaders []kafka.Header) *Entity {
+	state := &encoding{key: string(kkey)}
+	entity := encoder.encode(&kafka.Message{Key: kkey, Headers: kafkaHeaders}, data, state)
+	if entity != nil {
+		encoder.addHeaders(entity, kafkaHeaders, state)
+	}
+	return entity
+}
+
+// addHeaders adds the headers as kafka_header props. Header names are lowercased, like HTTP header names, so
+// names that only differ in case give one prop, with the value of the last of them.
+func (encoder EntityEncoder) addHeaders(entity *Entity, kafkaHeaders []kafka.Header, state *encoding) {
 	// create the kafka headers map and marshal it as json so we can reuse flatten method
 	headers := make(map[string]interface{})
 	for i := range kafkaHeaders {
@@ -62,24 +191,112 @@ func (encoder EntityEncoder) EncodeWithHeaders(kkey []byte, data []byte, kafkaHe
 	hd := string(headerData)
 	//add the headers to the entity
 	for k, v := range headers {
-		encoder.flatten("kafka_header.", k, v, hd, entity, key)
+		encoder.flatten("kafka_header.", k, v, hd, entity, state)
+	}
+}
+
+// keyId builds the entity id from the message key, or returns "" if the message has no key. Keys that already
+// are ids in the base namespace, like the tombstone keys written by producers without key, are used as is.
+func (encoder EntityEncoder) keyId(kkey []byte) string {
+	if len(kkey) == 0 {
+		return ""
+	}
+	if encoder.config.BaseNameSpace != "" && strings.HasPrefix(string(kkey), encoder.config.BaseNameSpace) {
+		return string(kkey)
+	}
+	if strings.Contains(encoder.config.EntityIdConstructor, "%") {
+		return encoder.config.BaseNameSpace + fmt.Sprintf(encoder.config.EntityIdConstructor, string(kkey))
+	}
+	return encoder.config.BaseNameSpace + string(kkey)
+}
+
+// templateId builds the entity id from the id template, or returns "" if any part of it is missing.
+// Value paths must point to a string, number or bool.
+func (encoder EntityEncoder) templateId(msg *kafka.Message, js string) string {
+	var sb strings.Builder
+	for _, part := range encoder.idTemplate.Parts {
+		value := ""
+		switch part.Source {
+		case "":
+			value = part.Literal
+		case conf.IdSourceKafkaKey:
+			value = string(msg.Key)
+		case conf.IdSourcePartition:
+			value = strconv.FormatInt(int64(msg.TopicPartition.Partition), 10)
+		case conf.IdSourceOffset:
+			value = strconv.FormatInt(int64(msg.TopicPartition.Offset), 10)
+		case conf.IdSourceHeader:
+			for _, h := range msg.Headers {
+				if strings.EqualFold(h.Key, part.Name) {
+					value = string(h.Value)
+				}
+			}
+		case conf.IdSourceValue:
+			if js == "" {
+				return ""
+			}
+			switch v := gjson.Get(js, part.Name); v.Type {
+			case gjson.String, gjson.Number, gjson.True, gjson.False:
+				value = v.String()
+			}
+		}
+		if value == "" && part.Source != "" {
+			return ""
+		}
+		sb.WriteString(value)
+	}
+	return encoder.config.BaseNameSpace + sb.String()
+}
+
+// addTypes adds rdf:type references from the configured types. If a typePath is configured, its value
+// selects a single type, either by full type uri or by the last segment of the uri.
+func (encoder EntityEncoder) addTypes(js string, entity *Entity) {
+	if len(encoder.config.Types) == 0 {
+		return
+	}
+	if encoder.config.TypePath == "" {
+		if len(encoder.config.Types) == 1 {
+			entity.References[RdfType] = encoder.config.Types[0]
+		} else {
+			types := make([]string, len(encoder.config.Types))
+			copy(types, encoder.config.Types)
+			entity.References[RdfType] = types
+		}
+		return
+	}
+
+	value := gjson.Get(js, encoder.config.TypePath)
+	if !value.Exists() {
+		return
+	}
+	selected := value.String()
+	for _, t := range encoder.config.Types {
+		if t == selected || t[strings.LastIndexAny(t, "/#")+1:] == selected {
+			entity.References[RdfType] = t
+			return
+		}
 	}
-	return entity
 }
 
-func (encoder EntityEncoder) flatten(prefix string, k string, v interface{}, js string, entity *Entity, key string) {
+func (encoder EntityEncoder) flatten(prefix string, k string, v interface{}, js string, entity *Entity, state *encoding) {
 	switch val := v.(type) {
 	case map[string]interface{}:
+		if encoder.mapContainer(k, js, entity, state) {
+			return
+		}
 		for k2, v2 := range val {
-			encoder.flatten(prefix+k+".", k2, v2, js, entity, key)
+			encoder.flatten(prefix+k+".", k2, v2, js, entity, state)
 		}
 	case []interface{}:
+		if hasObjects(val) && encoder.mapContainer(k, js, entity, state) {
+			return
+		}
 		objArray := true
 		for idx, i := range val {
 			switch ival := i.(type) {
 			case map[string]interface{}:
 				for k2, v2 := range ival {
-					encoder.flatten(fmt.Sprintf("%v%v.%v.", prefix, k, idx), k2, v2, js, entity, key)
+					encoder.flatten(fmt.Sprintf("%v%v.%v.", prefix, k, idx), k2, v2, js, entity, state)
 				}
 			default:
 				objArray = false
@@ -92,19 +309,19 @@ func (encoder EntityEncoder) flatten(prefix string, k string, v interface{}, js
 				for _, v := range val {
 					stringArray = append(stringArray, v.(string))
 				}
-				encoder.flatten(prefix, k, stringArray, js, entity, key)
+				encoder.flatten(prefix, k, stringArray, js, entity, state)
 			case float64:
 				var floatArray []float64
 				for _, v := range val {
 					floatArray = append(floatArray, v.(float64))
 				}
-				encoder.flatten(prefix, k, floatArray, js, entity, key)
+				encoder.flatten(prefix, k, floatArray, js, entity, state)
 			case bool:
 				var boolArray []bool
 				for _, v := range val {
 					boolArray = append(boolArray, v.(bool))
 				}
-				encoder.flatten(prefix, k, boolArray, js, entity, key)
+				encoder.flatten(prefix, k, boolArray, js, entity, state)
 			}
 		}
 	default:
@@ -113,32 +330,258 @@ func (encoder EntityEncoder) flatten(prefix string, k string, v interface{}, js
 			if mapping.IgnoreField {
 				return
 			}
+			encoder.applyMapping(mapping, fieldName, v, gjson.Get(js, mapping.Path), entity, state)
+		} else {
+			entity.Properties[fieldName] = v
+		}
+	}
 
-			propName := "ns0:" + mapping.FieldName
-			if mapping.PropertyName != "" {
-				propName = "ns0:" + mapping.PropertyName
-			}
+}
 
-			value := gjson.Get(js, mapping.Path)
-			if mapping.IsIdField {
-				if mapping.Path == "kafkaKey" {
-					entity.ID = encoder.config.BaseNameSpace + fmt.Sprintf(encoder.config.EntityIdConstructor, key)
-				} else {
-					entity.ID = encoder.config.BaseNameSpace + fmt.Sprintf(encoder.config.EntityIdConstructor, value.Value())
-					entity.Properties[fieldName] = v
-				}
-			} else if mapping.IsDeletedField {
-				entity.IsDeleted = value.Bool()
-			} else if mapping.IsReference && value.Exists() {
-				entity.References[propName] = fmt.Sprintf(mapping.ReferenceTemplate, value.Value())
-				entity.Properties[fieldName] = v
-			} else {
-				entity.Properties[propName] = value.Value()
-			}
+// applyMapping maps the value found at the path of the mapping. The raw field value v is kept as fieldName for
+// id and reference fields, unless fieldName is empty.
+func (encoder EntityEncoder) applyMapping(mapping *conf.FieldMapping, fieldName string, v interface{}, value gjson.Result, entity *Entity, state *encoding) {
+	propName := "ns0:" + mapping.FieldName
+	if mapping.PropertyName != "" {
+		propName = "ns0:" + mapping.PropertyName
+	}
+	if mapping.IsIdField && mapping.Path == "kafkaKey" {
+		if state.key != "" {
+			entity.ID = encoder.config.BaseNameSpace + fmt.Sprintf(encoder.config.EntityIdConstructor, state.key)
+		}
+		return
+	}
 
+	mapped, err := encoder.fieldValue(mapping, value)
+	if err != nil {
+		if encoder.config.OnMappingError != conf.OnMappingErrorDropField {
+			state.errs = append(state.errs, fmt.Errorf("field %s: %w", mapping.FieldName, err))
+		}
+		return
+	}
+	if mapping.IsIdField {
+		// missing id values are left to the idMissing policy
+		if mapped != nil {
+			entity.ID = encoder.config.BaseNameSpace + fmt.Sprintf(encoder.config.EntityIdConstructor, mapped)
+		}
+		if fieldName != "" {
+			entity.Properties[fieldName] = v
+		}
+	} else if mapping.IsDeletedField {
+		if b, ok := mapped.(bool); ok {
+			entity.IsDeleted = b
 		} else {
+			entity.IsDeleted = value.Bool()
+		}
+	} else if mapping.IsReference && mapped != nil {
+		entity.References[propName] = references(mapping.ReferenceTemplate, mapped)
+		if fieldName != "" {
 			entity.Properties[fieldName] = v
 		}
+	} else {
+		entity.Properties[propName] = mapped
+	}
+}
+
+// fieldValue returns the value at the path of the mapping, after its transforms and datatype are applied.
+// Missing and null values are nil.
+func (encoder EntityEncoder) fieldValue(mapping *conf.FieldMapping, value gjson.Result) (interface{}, error) {
+	if c, ok := encoder.conversions[mapping]; ok {
+		return c.apply(value)
+	}
+	if !value.Exists() {
+		return nil, nil
+	}
+	return value.Value(), nil
+}
+
+// addDefaults maps fields that are missing from the message, if their mapping has a default value.
+func (encoder EntityEncoder) addDefaults(js string, entity *Entity, state *encoding) {
+	for m, c := range encoder.conversions {
+		if m.IgnoreField || m.Path == "kafkaKey" || !c.hasDefault() || gjson.Get(js, m.Path).Exists() {
+			continue
+		}
+		encoder.applyMapping(m, "", nil, gjson.Result{}, entity, state)
+	}
+}
+
+func hasObjects(values []interface{}) bool {
+	for _, v := range values {
+		if _, ok := v.(map[string]interface{}); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mapContainer applies the mapping of an object or object array field. References are added next to the flattened
+// props, while nested entities replace them, in which case true is returned and the field is not flattened.
+func (encoder EntityEncoder) mapContainer(k string, js string, entity *Entity, state *encoding) bool {
+	mapping, ok := encoder.columns[k]
+	if !ok || mapping.IgnoreField {
+		return false
+	}
+	propName := "ns0:" + mapping.FieldName
+	if mapping.PropertyName != "" {
+		propName = "ns0:" + mapping.PropertyName
+	}
+
+	value := gjson.Get(js, mapping.Path)
+	switch {
+	case mapping.AsEntities:
+		if value.Exists() {
+			entity.Properties[propName] = encoder.nestedEntities(mapping, value)
+		}
+		return true
+	case mapping.IsReference && value.Exists():
+		encoder.applyMapping(mapping, "", nil, value, entity, state)
+	}
+	return false
+}
+
+// references applies the template to the value, or to each element if the value is an array. Elements that are
+// null, objects or arrays are left out.
+func references(template string, value interface{}) interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Sprintf(template, value)
+	}
+	refs := make([]string, 0)
+	for _, v := range list {
+		switch v.(type) {
+		case nil, map[string]interface{}, []interface{}:
+			continue
+		}
+		refs = append(refs, fmt.Sprintf(template, v))
+	}
+	return refs
+}
+
+// nestedEntities turns an object into a nested entity, or an array of objects into a list of them. The fields of
+// each object are flattened into props without applying the field mappings. With elementIdPath, the id is built
+// with the referenceTemplate.
+func (encoder EntityEncoder) nestedEntities(mapping *conf.FieldMapping, value gjson.Result) interface{} {
+	plain := EntityEncoder{config: encoder.config}
+	nested := func(obj gjson.Result) *Entity {
+		e := NewEntity()
+		items := make(map[string]interface{})
+		_ = json.Unmarshal([]byte(obj.Raw), &items)
+		for k, v := range items {
+			plain.flatten("", k, v, obj.Raw, e, &encoding{})
+		}
+		if mapping.ElementIdPath != "" {
+			if id := obj.Get(mapping.ElementIdPath); id.Exists() && id.Type != gjson.Null {
+				e.ID = fmt.Sprintf(mapping.ReferenceTemplate, id.Value())
+			}
+		}
+		return e
+	}
+
+	if !value.IsArray() {
+		if value.IsObject() {
+			return nested(value)
+		}
+		return value.Value()
+	}
+	entities := make([]*Entity, 0)
+	for _, obj := range value.Array() {
+		if obj.IsObject() {
+			entities = append(entities, nested(obj))
+		}
+	}
+	return entities
+}
+
+// nest adds the field to parent, keeping objects and arrays of objects as nested entities. Field mappings are
+// applied to the root entity, since their paths are relative to the message, so fields at the path of a mapping
+// are lifted out of the nested entities.
+func (encoder EntityEncoder) nest(path string, k string, v interface{}, js string, root *Entity, parent *Entity, state *encoding) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if (parent == root || encoder.mappedAt(path, k)) && encoder.mapContainer(k, js, root, state) {
+			return
+		}
+		parent.Properties[encoder.prefix(path)+":"+k] = encoder.nestedEntity(path+k, val, js, root, state)
+	case []interface{}:
+		if !hasObjects(val) {
+			encoder.nestLeaf(path, k, v, js, root, parent, state)
+			return
+		}
+		if (parent == root || encoder.mappedAt(path, k)) && encoder.mapContainer(k, js, root, state) {
+			return
+		}
+		list := make([]interface{}, len(val))
+		for i, item := range val {
+			if obj, ok := item.(map[string]interface{}); ok {
+				list[i] = encoder.nestedEntity(path+k, obj, js, root, state)
+			} else {
+				list[i] = item
+			}
+		}
+		parent.Properties[encoder.prefix(path)+":"+k] = list
+	default:
+		encoder.nestLeaf(path, k, v, js, root, parent, state)
+	}
+}
+
+func (encoder EntityEncoder) nestedEntity(path string, obj map[string]interface{}, js string, root *Entity, state *encoding) *Entity {
+	entity := NewEntity()
+	for k, v := range obj {
+		encoder.nest(path+".", k, v, js, root, entity, state)
+	}
+	return entity
+}
+
+func (encoder EntityEncoder) nestLeaf(path string, k string, v interface{}, js string, root *Entity, parent *Entity, state *encoding) {
+	if parent == root || encoder.mappedAt(path, k) {
+		encoder.flatten("", k, v, js, root, state)
+		return
 	}
+	parent.Properties[encoder.prefix(path)+":"+k] = v
+}
 
+// mappedAt tells if the field k of the object at path is the one a field mapping points to. Mappings are looked up
+// by field name, which is not unique across nested objects, like the id of the message and the ids of its lines.
+func (encoder EntityEncoder) mappedAt(path string, k string) bool {
+	mapping, ok := encoder.columns[k]
+	return ok && mapping.Path == path+k
+}
+
+// prefix returns the namespace prefix for the props of the object at path, like "lines." or "order.address.".
+func (encoder EntityEncoder) prefix(path string) string {
+	if prefix, ok := encoder.prefixes[strings.TrimSuffix(path, ".")]; ok {
+		return prefix
+	}
+	return "ns0"
+}
+
+// nestedIds gives nested entities without id an id built from the id of their parent and the field name,
+// and the index for entities in lists, like "<id>/lines/0".
+func nestedIds(entity *Entity) {
+	for name, v := range entity.Properties {
+		local := StripNamespace(name)
+		switch val := v.(type) {
+		case *Entity:
+			if val.ID == "" {
+				val.ID = entity.ID + "/" + local
+			}
+			nestedIds(val)
+		case []interface{}:
+			for i, item := range val {
+				if child, ok := item.(*Entity); ok {
+					if child.ID == "" {
+						child.ID = fmt.Sprintf("%s/%s/%d", entity.ID, local, i)
+					}
+					nestedIds(child)
+				}
+			}
+		case []*Entity:
+			for i, child := range val {
+				if child.ID == "" {
+					child.ID = fmt.Sprintf("%s/%s/%d", entity.ID, local, i)
+				}
+				nestedIds(child)
+			}
+		}
+	}
 }
\ No newline at end of file
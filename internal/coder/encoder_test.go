@@ -3,6 +3,7 @@ package coder
 import (
 	"testing"
 
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/franela/goblin"
 
 	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
@@ -47,20 +48,26 @@ func TestEncoder(t *testing.T) {
 			References: map[string]interface{}{},
 			Properties: map[string]interface{}{}}
 		g.Describe("Encode", func() {
-			g.It("Should encode primitives", func() {
+			g.It("Should skip primitives", func() {
 				res := enc.Encode([]byte("kafkakey1"), []byte(`"hello"`))
-				g.Assert(*res).Eql(emptyEntity, "cannot map properties, but should not stop streaming")
+				g.Assert(res == nil).IsTrue("cannot map the id, but should not stop streaming")
 			})
-			g.It("Should encode invalid json", func() {
+			g.It("Should skip invalid json", func() {
 				res := enc.Encode([]byte("kafkakey1"), []byte("{,sse]}"))
-				g.Assert(*res).Eql(emptyEntity, "cannot map properties, but should not stop streaming")
+				g.Assert(res == nil).IsTrue("cannot map the id, but should not stop streaming")
 			})
-			g.It("Should encode nil", func() {
+			g.It("Should encode nil as deleted entity", func() {
 				res := enc.Encode([]byte("kafkakey1"), nil)
-				g.Assert(*res).Eql(emptyEntity, "cannot map properties, but should not stop streaming")
+				g.Assert(res.ID).Eql("test_ns/people/mainId/kafkakey1.json")
+				g.Assert(res.IsDeleted).IsTrue("a tombstone deletes the entity of its key")
+				g.Assert(res.Properties).Eql(emptyEntity.Properties)
+			})
+			g.It("Should skip nil without key", func() {
+				res := enc.Encode(nil, nil)
+				g.Assert(res == nil).IsTrue("a tombstone without key cannot be identified")
 			})
 			g.It("Should encode simple object", func() {
-				res := enc.Encode([]byte("kafkakey1"), []byte(`{
+				res := NewEntityEncoder(&conf.ConsumerConfig{}).Encode([]byte("kafkakey1"), []byte(`{
 					"key1": "value1"
 				}`))
 				g.Assert(res).IsNotNil()
@@ -87,12 +94,13 @@ func TestEncoder(t *testing.T) {
 			})
 			g.It("Should map reference from simple object", func() {
 				res := enc.Encode([]byte("kafkakey1"), []byte(`{
+					"idkey": "id1",
 					"refkey": "value1",
 					"refkey2": "value2",
 					"refkey3": "value3"
 				}`))
 				g.Assert(len(res.References)).Eql(2, "ignored ref field refkey3")
-				g.Assert(len(res.Properties)).Eql(2, "ignored ref field refkey3")
+				g.Assert(len(res.Properties)).Eql(3, "ignored ref field refkey3")
 				g.Assert(res.References["ns0:refkeyprop"]).Eql("http://foo/value1")
 				g.Assert(res.References["ns0:refkey2"]).Eql("http://bar/value2")
 				g.Assert(res.Properties["ns0:refkey"]).Eql("value1")
@@ -100,6 +108,7 @@ func TestEncoder(t *testing.T) {
 			})
 			g.It("Should map nested object", func() {
 				res := enc.Encode([]byte("kafkakey1"), []byte(`{
+					"idkey": "id1",
 					"o1": {
 						"n1": 1,
 						"a1": ["av1", "av2"],
@@ -114,7 +123,7 @@ func TestEncoder(t *testing.T) {
 					},
 					"s1": "sv1"
 				}`))
-				g.Assert(len(res.Properties)).Eql(7)
+				g.Assert(len(res.Properties)).Eql(8)
 				g.Assert(res.Properties["ns0:s1"]).Eql("sv1")
 				g.Assert(res.Properties["ns0:o1.n1"]).Eql(1.0)
 				g.Assert(res.Properties["ns0:o1.a1"]).Eql([]string{"av1", "av2"})
@@ -124,5 +133,249 @@ func TestEncoder(t *testing.T) {
 				g.Assert(res.Properties["ns0:o1.o2.a2.3.a4"]).Eql([]bool{true, false})
 			})
 		})
+		g.Describe("Types", func() {
+			g.It("Should add all configured types", func() {
+				typed := NewEntityEncoder(&conf.ConsumerConfig{
+					Types: []string{"http://example.com/person", "http://example.com/address"},
+				})
+				res := typed.Encode(nil, []byte(`{"key1": "value1"}`))
+				g.Assert(res.References[RdfType]).Eql([]string{"http://example.com/person", "http://example.com/address"})
+			})
+			g.It("Should select type from typePath", func() {
+				typed := NewEntityEncoder(&conf.ConsumerConfig{
+					Types:    []string{"http://example.com/person", "http://example.com/address"},
+					TypePath: "kind",
+				})
+				res := typed.Encode(nil, []byte(`{"kind": "address"}`))
+				g.Assert(res.References[RdfType]).Eql("http://example.com/address")
+				res = typed.Encode(nil, []byte(`{"kind": "http://example.com/person"}`))
+				g.Assert(res.References[RdfType]).Eql("http://example.com/person")
+				res = typed.Encode(nil, []byte(`{"kind": "pet"}`))
+				g.Assert(res.References[RdfType] == nil).IsTrue("unknown type should not be set")
+			})
+		})
+		g.Describe("Ids", func() {
+			msg := &kafka.Message{
+				Key:            []byte("k1"),
+				Headers:        []kafka.Header{{Key: "Tenant", Value: []byte("acme")}},
+				TopicPartition: kafka.TopicPartition{Partition: 2, Offset: 42},
+			}
+			g.It("Should build ids from a template", func() {
+				templated := NewEntityEncoder(&conf.ConsumerConfig{
+					BaseNameSpace: "http://data.example.io/",
+					IdTemplate:    "order/{header:tenant}/{order.number}-{kafkaKey}@{partition}.{offset}",
+				})
+				res, _ := templated.EncodeMessage(msg, []byte(`{"order": {"number": 1042}}`))
+				g.Assert(res.ID).Eql("http://data.example.io/order/acme/1042-k1@2.42")
+			})
+			g.It("Should apply the idMissing policy", func() {
+				config := &conf.ConsumerConfig{IdTemplate: "{tenant}-{order}"}
+				res, _ := NewEntityEncoder(config).EncodeMessage(msg, []byte(`{"tenant": "acme"}`))
+				g.Assert(res == nil).IsTrue("message without id should be skipped by default")
+
+				config.IdMissing = conf.IdMissingKafkaKey
+				res, _ = NewEntityEncoder(config).EncodeMessage(msg, []byte(`{"tenant": "acme", "order": null}`))
+				g.Assert(res.ID).Eql("k1")
+
+				config.IdMissing = conf.IdMissingPartitionOffset
+				res, _ = NewEntityEncoder(config).EncodeMessage(msg, []byte(`{"tenant": "acme", "order": {}}`))
+				g.Assert(res.ID).Eql("2-42")
+
+				config.IdMissing = conf.IdMissingSkip
+				res, _ = NewEntityEncoder(config).EncodeMessage(msg, []byte(`{"tenant": "acme"}`))
+				g.Assert(res == nil).IsTrue("message without id should be skipped")
+			})
+			g.It("Should identify tombstones by their key when skipping messages without id", func() {
+				config := &conf.ConsumerConfig{IdTemplate: "{tenant}-{order}", IdMissing: conf.IdMissingSkip}
+				res, _ := NewEntityEncoder(config).EncodeMessage(msg, nil)
+				g.Assert(res == nil).IsFalse("keyed tombstones should not be skipped")
+				g.Assert(res.ID).Eql("k1")
+				g.Assert(res.IsDeleted).IsTrue()
+
+				res, _ = NewEntityEncoder(config).EncodeMessage(&kafka.Message{}, nil)
+				g.Assert(res == nil).IsTrue("tombstones without key should be skipped")
+			})
+			g.It("Should not build ids from null id fields", func() {
+				res := enc.Encode([]byte("k1"), []byte(`{"idkey": null}`))
+				g.Assert(res == nil).IsTrue("message without id should be skipped by default")
+			})
+		})
+		g.Describe("Multi valued fields", func() {
+			multi := NewEntityEncoder(&conf.ConsumerConfig{
+				FieldMappings: []*conf.FieldMapping{
+					{
+						Path:              "orderLineIds",
+						FieldName:         "orderLineIds",
+						PropertyName:      "orderLines",
+						IsReference:       true,
+						ReferenceTemplate: "http://data.example.io/orderline/%v",
+					}, {
+						Path:              "products.#.sku",
+						FieldName:         "products",
+						IsReference:       true,
+						ReferenceTemplate: "http://data.example.io/product/%v",
+					}, {
+						Path:              "lines",
+						FieldName:         "lines",
+						AsEntities:        true,
+						ElementIdPath:     "no",
+						ReferenceTemplate: "http://data.example.io/line/%v",
+					}},
+			})
+			res := multi.Encode(nil, []byte(`{
+				"orderLineIds": [1, 2, 3],
+				"products": [{"sku": "a1"}, {"sku": "b2"}, {"name": "no sku"}],
+				"lines": [{"no": 1, "sku": "a1", "price": {"amount": 10}}, {"sku": "b2"}]
+			}`))
+			g.It("Should map arrays to a list of references", func() {
+				g.Assert(res.References["ns0:orderLines"]).Eql([]string{
+					"http://data.example.io/orderline/1",
+					"http://data.example.io/orderline/2",
+					"http://data.example.io/orderline/3",
+				})
+				g.Assert(res.Properties["ns0:orderLineIds"]).Eql([]float64{1, 2, 3})
+			})
+			g.It("Should map object arrays to a list of references", func() {
+				g.Assert(res.References["ns0:products"]).Eql([]string{
+					"http://data.example.io/product/a1",
+					"http://data.example.io/product/b2",
+				})
+				g.Assert(res.Properties["ns0:products.0.sku"]).Eql("a1")
+			})
+			g.It("Should map object arrays to nested entities", func() {
+				lines := res.Properties["ns0:lines"].([]*Entity)
+				g.Assert(len(lines)).Eql(2)
+				g.Assert(lines[0].ID).Eql("http://data.example.io/line/1")
+				g.Assert(lines[0].Properties["ns0:sku"]).Eql("a1")
+				g.Assert(lines[0].Properties["ns0:price.amount"]).Eql(10.0)
+				g.Assert(lines[1].ID).Eql("")
+				_, exploded := res.Properties["ns0:lines.0.sku"]
+				g.Assert(exploded).IsFalse("nested entities should not be flattened")
+			})
+		})
+		g.Describe("Nesting", func() {
+			config := &conf.ConsumerConfig{
+				BaseNameSpace:       "http://data.example.io/",
+				NameSpace:           "order",
+				EntityIdConstructor: "order/%v",
+				Nesting:             conf.NestingEntities,
+				NestedNameSpaces:    map[string]string{"lines": "orderline"},
+				FieldMappings: []*conf.FieldMapping{
+					{Path: "id", FieldName: "id", IsIdField: true},
+					{
+						Path:              "customer.customerId",
+						FieldName:         "customerId",
+						PropertyName:      "customer",
+						IsReference:       true,
+						ReferenceTemplate: "http://data.example.io/customer/%v",
+					}},
+			}
+			nested := NewEntityEncoder(config)
+			res := nested.Encode(nil, []byte(`{
+				"id": 1,
+				"customer": {"customerId": 7, "address": {"street": "Main street 1"}},
+				"lines": [{"id": "l1", "sku": "a1", "qty": 2}, {"id": "l2", "sku": "b2", "tags": ["x", "y"]}],
+				"notes": ["fragile"]
+			}`))
+			g.It("Should keep sub objects as nested entities", func() {
+				g.Assert(res.ID).Eql("http://data.example.io/order/1")
+				customer := res.Properties["ns0:customer"].(*Entity)
+				g.Assert(customer.ID).Eql("http://data.example.io/order/1/customer")
+				address := customer.Properties["ns0:address"].(*Entity)
+				g.Assert(address.ID).Eql("http://data.example.io/order/1/customer/address")
+				g.Assert(address.Properties["ns0:street"]).Eql("Main street 1")
+				g.Assert(res.Properties["ns0:notes"]).Eql([]string{"fragile"})
+			})
+			g.It("Should keep arrays of objects as lists of nested entities", func() {
+				lines := res.Properties["ns0:lines"].([]interface{})
+				g.Assert(len(lines)).Eql(2)
+				second := lines[1].(*Entity)
+				g.Assert(second.ID).Eql("http://data.example.io/order/1/lines/1")
+				g.Assert(second.Properties["ns1:sku"]).Eql("b2")
+				g.Assert(second.Properties["ns1:tags"]).Eql([]interface{}{"x", "y"})
+			})
+			g.It("Should keep nested fields named like a mapping that points elsewhere", func() {
+				lines := res.Properties["ns0:lines"].([]interface{})
+				g.Assert(lines[0].(*Entity).Properties["ns1:id"]).Eql("l1")
+				g.Assert(lines[1].(*Entity).Properties["ns1:id"]).Eql("l2")
+				g.Assert(res.ID).Eql("http://data.example.io/order/1")
+				g.Assert(res.Properties["ns0:id"]).Eql(1.0)
+			})
+			g.It("Should apply field mappings to the top level entity", func() {
+				g.Assert(res.References["ns0:customer"]).Eql("http://data.example.io/customer/7")
+				_, ok := res.Properties["ns0:customer.customerId"]
+				g.Assert(ok).IsFalse("nested fields should not be flattened")
+			})
+			g.It("Should add nested namespaces to the context", func() {
+				namespaces := DatasetContext(config)["namespaces"].(map[string]string)
+				g.Assert(namespaces["ns1"]).Eql("http://data.example.io/orderline/")
+			})
+		})
+		g.Describe("Conversions", func() {
+			config := &conf.ConsumerConfig{
+				BaseNameSpace:       "http://data.example.io/",
+				EntityIdConstructor: "order/%v",
+				FieldMappings: []*conf.FieldMapping{
+					{Path: "orderNo", FieldName: "orderNo", IsIdField: true, Datatype: conf.DatatypeInt},
+					{Path: "created", FieldName: "created", Datatype: conf.DatatypeDatetime, DatetimeFormat: conf.DatetimeEpochMillis},
+					{Path: "shipped", FieldName: "shipped", Datatype: conf.DatatypeDatetime, DatetimeFormat: "02.01.2006"},
+					{Path: "paid", FieldName: "paid", Transforms: []*conf.Transform{
+						{Type: conf.TransformMap, Values: map[string]interface{}{"Y": true, "N": false}},
+					}, Datatype: conf.DatatypeBool},
+					{Path: "email", FieldName: "email", Transforms: []*conf.Transform{
+						{Type: conf.TransformTrim}, {Type: conf.TransformLowercase},
+					}},
+					{Path: "phone", FieldName: "phone", Transforms: []*conf.Transform{
+						{Type: conf.TransformReplace, Pattern: "[^0-9+]", Replacement: ""},
+					}},
+					{Path: "status", FieldName: "status", Transforms: []*conf.Transform{
+						{Type: conf.TransformDefault, Value: "open"},
+					}},
+					{Path: "trackingId", FieldName: "trackingId", Datatype: conf.DatatypeUUID},
+					{
+						Path:              "customerNo",
+						FieldName:         "customerNo",
+						IsReference:       true,
+						ReferenceTemplate: "http://data.example.io/customer/%v",
+						Datatype:          conf.DatatypeString,
+					}},
+			}
+			msg := &kafka.Message{Key: []byte("k1")}
+			value := []byte(`{
+				"orderNo": 10420000000,
+				"created": 1651067941000,
+				"shipped": "28.04.2022",
+				"paid": "Y",
+				"email": "  Bob@Example.COM ",
+				"phone": "+47 (22) 11 22 33",
+				"trackingId": "6BA7B810-9DAD-11D1-80B4-00C04FD430C8",
+				"customerNo": 7.5
+			}`)
+			g.It("Should transform and convert mapped values", func() {
+				res, err := NewEntityEncoder(config).EncodeMessage(msg, value)
+				g.Assert(err).IsNil()
+				g.Assert(res.ID).Eql("http://data.example.io/order/10420000000")
+				g.Assert(res.Properties["ns0:created"]).Eql("2022-04-27T13:59:01Z")
+				g.Assert(res.Properties["ns0:shipped"]).Eql("2022-04-28T00:00:00Z")
+				g.Assert(res.Properties["ns0:paid"]).Eql(true)
+				g.Assert(res.Properties["ns0:email"]).Eql("bob@example.com")
+				g.Assert(res.Properties["ns0:phone"]).Eql("+4722112233")
+				g.Assert(res.Properties["ns0:status"]).Eql("open")
+				g.Assert(res.Properties["ns0:trackingId"]).Eql("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+				g.Assert(res.References["ns0:customerNo"]).Eql("http://data.example.io/customer/7.5")
+			})
+			g.It("Should report values that can not be converted", func() {
+				res, err := NewEntityEncoder(config).EncodeMessage(msg, []byte(`{"orderNo": 1, "paid": "maybe"}`))
+				g.Assert(res == nil).IsTrue("unmappable message should give no entity")
+				g.Assert(err == nil).IsFalse("expected a mapping error")
+
+				config.OnMappingError = conf.OnMappingErrorDropField
+				res, err = NewEntityEncoder(config).EncodeMessage(msg, []byte(`{"orderNo": 1, "paid": "maybe"}`))
+				g.Assert(err).IsNil()
+				_, ok := res.Properties["ns0:paid"]
+				g.Assert(ok).IsFalse("unconvertible field should be dropped")
+				g.Assert(res.ID).Eql("http://data.example.io/order/1")
+			})
+		})
 	})
 }
\ No newline at end of file
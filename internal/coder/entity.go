@@ -29,14 +29,41 @@ func NewEntity() *Entity {
 }
 
 func (entity *Entity) StripProps() ([]byte, error) {
+	return json.Marshal(entity.StrippedMap())
+}
+
+// StrippedMap returns id, deleted and props of the entity, with namespace prefixes removed from
+// the id and the property keys.
+func (entity *Entity) StrippedMap() map[string]interface{} {
 	var stripped = make(map[string]interface{})
-	stripped["id"] = strings.SplitAfter(entity.ID, ":")[1]
+	stripped["id"] = StripNamespace(entity.ID)
 	stripped["deleted"] = entity.IsDeleted
 
 	var singleMap = make(map[string]interface{})
 	for e, _ := range entity.Properties {
-		singleMap[strings.SplitAfter(e, ":")[1]] = entity.Properties[e]
+		singleMap[StripNamespace(e)] = entity.Properties[e]
 	}
 	stripped["props"] = singleMap
-	return json.Marshal(stripped)
+	return stripped
+}
+
+// StripNamespace removes the namespace prefix from a name like "ns0:name". Names without prefix are returned as is.
+func StripNamespace(name string) string {
+	if _, local, found := strings.Cut(name, ":"); found {
+		return local
+	}
+	return name
+}
+
+// ExpandNamespace replaces the namespace prefix of a name like "ns0:name" with the namespace uri from the context.
+// Names without a known prefix are returned as is.
+func ExpandNamespace(name string, ctx *Context) string {
+	prefix, local, found := strings.Cut(name, ":")
+	if !found || ctx == nil {
+		return name
+	}
+	if uri, ok := ctx.Namespaces[prefix].(string); ok {
+		return uri + local
+	}
+	return name
 }
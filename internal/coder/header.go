@@ -0,0 +1,101 @@
+package coder
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// kafkaHeaderPrefix marks props that hold kafka headers, see EntityEncoder.EncodeWithHeaders.
+const kafkaHeaderPrefix = "kafka_header."
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// HeaderBuilder builds the message headers for the entities of a producer dataset.
+type HeaderBuilder struct {
+	dataset   string
+	mappings  []*conf.HeaderMapping
+	paths     map[string]conf.KeyPart
+	propagate bool
+}
+
+func NewHeaderBuilder(config *conf.ProducerConfig) (*HeaderBuilder, error) {
+	paths := make(map[string]conf.KeyPart)
+	for _, m := range config.Headers {
+		if m.Source != conf.HeaderSourceProperty {
+			continue
+		}
+		part, err := conf.ParseEntityPath(m.Path)
+		if err != nil {
+			return nil, err
+		}
+		paths[m.Name] = part
+	}
+	return &HeaderBuilder{
+		dataset:   config.Dataset,
+		mappings:  config.Headers,
+		paths:     paths,
+		propagate: config.PropagateHeaders,
+	}, nil
+}
+
+// Headers returns the headers of the entity message. Propagated headers come first, so configured headers
+// with the same name replace them. Property headers are left out if the entity has no value for them.
+func (builder *HeaderBuilder) Headers(entity *Entity, now time.Time) []Header {
+	if len(builder.mappings) == 0 && !builder.propagate {
+		return nil
+	}
+
+	headers := make([]Header, 0, len(builder.mappings))
+	index := make(map[string]int)
+	add := func(key string, value string) {
+		if i, ok := index[key]; ok {
+			headers[i].Value = []byte(value)
+			return
+		}
+		index[key] = len(headers)
+		headers = append(headers, Header{Key: key, Value: []byte(value)})
+	}
+
+	if builder.propagate {
+		for k, v := range entity.Properties {
+			name := k
+			if _, local, found := strings.Cut(k, ":"); found {
+				name = local
+			}
+			if !strings.HasPrefix(name, kafkaHeaderPrefix) {
+				continue
+			}
+			if value, ok := keyString(v); ok {
+				add(strings.TrimPrefix(name, kafkaHeaderPrefix), value)
+			}
+		}
+	}
+
+	for _, m := range builder.mappings {
+		switch m.Source {
+		case conf.HeaderSourceStatic:
+			add(m.Name, m.Value)
+		case conf.HeaderSourceId:
+			add(m.Name, entity.ID)
+		case conf.HeaderSourceDataset:
+			add(m.Name, builder.dataset)
+		case conf.HeaderSourceProperty:
+			if value, ok := entityPathValue(entity, builder.paths[m.Name]); ok {
+				add(m.Name, value)
+			}
+		case conf.HeaderSourceCorrelationId:
+			id, _ := uuid.GenerateUUID()
+			add(m.Name, id)
+		case conf.HeaderSourceTimestamp:
+			add(m.Name, now.UTC().Format(time.RFC3339Nano))
+		}
+	}
+	return headers
+}
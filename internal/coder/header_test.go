@@ -0,0 +1,95 @@
+package coder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/franela/goblin"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+func TestHeaderBuilder(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("A HeaderBuilder", func() {
+		entity := NewEntity()
+		entity.ID = "ns0:customer-1"
+		entity.Properties["ns0:customerId"] = 1042.0
+		entity.Properties["ns0:kafka_header.source"] = "crm"
+		entity.Properties["ns0:kafka_header.trace"] = "abc"
+
+		headers := func(config *conf.ProducerConfig) map[string]string {
+			b, err := NewHeaderBuilder(config)
+			g.Assert(err).IsNil()
+			result := make(map[string]string)
+			for _, h := range b.Headers(entity, time.Date(2022, 4, 27, 13, 59, 1, 0, time.UTC)) {
+				result[h.Key] = string(h.Value)
+			}
+			return result
+		}
+
+		g.It("should not add headers by default", func() {
+			g.Assert(len(headers(&conf.ProducerConfig{Dataset: "customers"}))).Eql(0)
+		})
+		g.It("should map configured headers", func() {
+			result := headers(&conf.ProducerConfig{
+				Dataset: "customers",
+				Headers: []*conf.HeaderMapping{
+					{Name: "origin", Source: conf.HeaderSourceStatic, Value: "datahub"},
+					{Name: "entity", Source: conf.HeaderSourceId},
+					{Name: "dataset", Source: conf.HeaderSourceDataset},
+					{Name: "customer", Source: conf.HeaderSourceProperty, Path: "props:ns0:customerId"},
+					{Name: "missing", Source: conf.HeaderSourceProperty, Path: "props:ns0:other"},
+					{Name: "correlation", Source: conf.HeaderSourceCorrelationId},
+					{Name: "produced", Source: conf.HeaderSourceTimestamp},
+				},
+			})
+			g.Assert(result["origin"]).Eql("datahub")
+			g.Assert(result["entity"]).Eql("ns0:customer-1")
+			g.Assert(result["dataset"]).Eql("customers")
+			g.Assert(result["customer"]).Eql("1042")
+			g.Assert(result["produced"]).Eql("2022-04-27T13:59:01Z")
+			g.Assert(len(result["correlation"])).Eql(36)
+			_, ok := result["missing"]
+			g.Assert(ok).IsFalse("missing properties should not give a header")
+		})
+		g.It("should propagate consumed headers", func() {
+			result := headers(&conf.ProducerConfig{
+				PropagateHeaders: true,
+				Headers: []*conf.HeaderMapping{
+					{Name: "source", Source: conf.HeaderSourceStatic, Value: "datalayer"},
+				},
+			})
+			g.Assert(result["trace"]).Eql("abc")
+			g.Assert(result["source"]).Eql("datalayer", "configured headers replace propagated headers")
+		})
+	})
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("Consumed headers", func() {
+		msg := &kafka.Message{
+			Key:     []byte("customer-1"),
+			Headers: []kafka.Header{{Key: "X-Tenant", Value: []byte("acme")}, {Key: "trace", Value: []byte("abc")}},
+		}
+		encoder := NewEntityEncoder(&conf.ConsumerConfig{IncludeHeaders: true})
+		entity, err := encoder.EncodeMessage(msg, []byte(`{"name": "Bob"}`))
+
+		g.It("should be lowercased props", func() {
+			g.Assert(err).IsNil()
+			g.Assert(entity.Properties["ns0:kafka_header.x-tenant"]).Eql("acme")
+			g.Assert(entity.Properties["ns0:kafka_header.trace"]).Eql("abc")
+		})
+		g.It("should be propagated with lowercased names", func() {
+			b, err := NewHeaderBuilder(&conf.ProducerConfig{PropagateHeaders: true})
+			g.Assert(err).IsNil()
+			result := make(map[string]string)
+			for _, h := range b.Headers(entity, time.Now()) {
+				result[h.Key] = string(h.Value)
+			}
+			g.Assert(result).Eql(map[string]string{"x-tenant": "acme", "trace": "abc"})
+		})
+	})
+}
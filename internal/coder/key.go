@@ -0,0 +1,129 @@
+package coder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-uuid"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+var ErrKeyMissing = errors.New("key value is missing")
+
+// KeyBuilder builds message keys for the entities of a producer dataset.
+type KeyBuilder struct {
+	key     *conf.Key
+	missing string
+}
+
+// NewKeyBuilder returns a builder for the key of the config. Keys that cannot be parsed are reported as warnings
+// by the validation, and messages are written without key, like before keys other than id and uuid were supported.
+func NewKeyBuilder(config *conf.ProducerConfig) *KeyBuilder {
+	key, err := conf.ParseKey(config.Key)
+	if err != nil {
+		key = &conf.Key{Kind: conf.KeyNone}
+	}
+	missing := config.KeyMissing
+	if missing == "" {
+		missing = conf.KeyMissingFail
+	}
+	return &KeyBuilder{key: key, missing: missing}
+}
+
+// Key returns the message key of the entity, or nil if messages are written without key. If a value of the
+// key is missing, the keyMissing policy decides whether this fails, falls back to the entity id or gives a nil key.
+func (builder *KeyBuilder) Key(entity *Entity) ([]byte, error) {
+	switch builder.key.Kind {
+	case conf.KeyNone:
+		return nil, nil
+	case conf.KeyId:
+		return []byte(entity.ID), nil
+	case conf.KeyUUID:
+		id, _ := uuid.GenerateUUID()
+		return []byte(id), nil
+	}
+
+	var sb strings.Builder
+	for _, part := range builder.key.Parts {
+		if part.Source == "" {
+			sb.WriteString(part.Literal)
+			continue
+		}
+		value, ok := entityPathValue(entity, part)
+		if !ok {
+			switch builder.missing {
+			case conf.KeyMissingId:
+				return []byte(entity.ID), nil
+			case conf.KeyMissingNull:
+				return nil, nil
+			default:
+				return nil, fmt.Errorf("%w: entity %s has no %s:%s", ErrKeyMissing, entity.ID, part.Source, part.Name)
+			}
+		}
+		sb.WriteString(value)
+	}
+	return []byte(sb.String()), nil
+}
+
+// TombstoneKey is the key of a tombstone for datasets without key, so the deleted entity can still be identified.
+// It is the entity id with its namespace expanded, which the consumers of this datalayer use as entity id as is.
+func TombstoneKey(entity *Entity, ctx *Context) []byte {
+	return []byte(ExpandNamespace(entity.ID, ctx))
+}
+
+func entityPathValue(entity *Entity, part conf.KeyPart) (string, bool) {
+	_, v, ok := entityPathRaw(entity, part)
+	if !ok {
+		return "", false
+	}
+	return keyString(v)
+}
+
+// entityPathRaw looks up the value of an entity path, and the prop or ref name it was found under.
+func entityPathRaw(entity *Entity, part conf.KeyPart) (string, interface{}, bool) {
+	var values map[string]interface{}
+	switch part.Source {
+	case conf.KeySourceId:
+		return "", entity.ID, entity.ID != ""
+	case conf.KeySourceProps:
+		values = entity.Properties
+	case conf.KeySourceRefs:
+		values = entity.References
+	}
+
+	if v, ok := values[part.Name]; ok {
+		return part.Name, v, true
+	}
+	if !strings.Contains(part.Name, ":") {
+		// without namespace prefix, the name matches any prefix
+		for k, v := range values {
+			if _, local, found := strings.Cut(k, ":"); found && local == part.Name {
+				return k, v, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func keyString(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, val != ""
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(val), true
+	case []interface{}:
+		// a single value list is common for references
+		if len(val) == 1 {
+			return keyString(val[0])
+		}
+		return "", false
+	default:
+		// lists and objects do not make a stable key
+		return "", false
+	}
+}
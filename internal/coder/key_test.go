@@ -0,0 +1,85 @@
+package coder
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/franela/goblin"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+func TestKeyBuilder(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("A KeyBuilder", func() {
+		entity := NewEntity()
+		entity.ID = "ns0:customer-1"
+		entity.Properties["ns0:customerId"] = 1042.0
+		entity.Properties["ns3:region"] = "north"
+		entity.References["ns0:country"] = []interface{}{"ns4:NO"}
+
+		builder := func(key string, missing string) *KeyBuilder {
+			return NewKeyBuilder(&conf.ProducerConfig{Key: &key, KeyMissing: missing})
+		}
+
+		g.It("should use a single prop", func() {
+			key, err := builder("props:ns0:customerId", "").Key(entity)
+			g.Assert(err).IsNil()
+			g.Assert(string(key)).Eql("1042")
+		})
+		g.It("should match props without namespace prefix", func() {
+			key, err := builder("props:region", "").Key(entity)
+			g.Assert(err).IsNil()
+			g.Assert(string(key)).Eql("north")
+		})
+		g.It("should combine fields in a template", func() {
+			key, err := builder("{refs:ns0:country}/{props:ns0:customerId}", "").Key(entity)
+			g.Assert(err).IsNil()
+			g.Assert(string(key)).Eql("ns4:NO/1042")
+		})
+		g.It("should fail on missing values by default", func() {
+			_, err := builder("props:ns0:missing", "").Key(entity)
+			g.Assert(errors.Is(err, ErrKeyMissing)).IsTrue(err)
+		})
+		g.It("should fall back to the id", func() {
+			key, err := builder("props:ns0:missing", conf.KeyMissingId).Key(entity)
+			g.Assert(err).IsNil()
+			g.Assert(string(key)).Eql("ns0:customer-1")
+		})
+		g.It("should give a null key", func() {
+			key, err := builder("x-{props:ns0:missing}", conf.KeyMissingNull).Key(entity)
+			g.Assert(err).IsNil()
+			g.Assert(key == nil).IsTrue()
+		})
+		g.It("should write without key when the key is not supported", func() {
+			key, err := builder("customer", "").Key(entity)
+			g.Assert(err).IsNil()
+			g.Assert(key == nil).IsTrue()
+		})
+	})
+}
+
+func TestTombstoneKey(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("A tombstone key", func() {
+		ctx := &Context{Namespaces: map[string]interface{}{"ns0": "http://data.example.io/people/"}}
+		entity := NewEntity()
+		entity.ID = "ns0:Bob"
+		entity.IsDeleted = true
+
+		g.It("should be the expanded entity id", func() {
+			g.Assert(string(TombstoneKey(entity, ctx))).Eql("http://data.example.io/people/Bob")
+		})
+		g.It("should delete the same entity when it is consumed", func() {
+			for _, constructor := range []string{"", "person/%v"} {
+				encoder := NewEntityEncoder(&conf.ConsumerConfig{
+					BaseNameSpace:       "http://data.example.io/",
+					EntityIdConstructor: constructor,
+				})
+				res := encoder.Encode(TombstoneKey(entity, ctx), nil)
+				g.Assert(res.ID).Eql("http://data.example.io/people/Bob")
+				g.Assert(res.IsDeleted).IsTrue()
+			}
+		})
+	})
+}
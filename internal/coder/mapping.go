@@ -0,0 +1,196 @@
+package coder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// OutboundMapper shapes entities into message values for producers with a mapping.
+type OutboundMapper struct {
+	namespaces   string
+	dropUnmapped bool
+	fields       []outboundField
+}
+
+type outboundField struct {
+	deleted bool
+	part    conf.KeyPart
+	path    []string
+	ignore  bool
+}
+
+func NewOutboundMapper(mapping *conf.OutboundMapping) (*OutboundMapper, error) {
+	mapper := &OutboundMapper{
+		namespaces:   mapping.Namespaces,
+		dropUnmapped: mapping.DropUnmapped,
+	}
+	if mapper.namespaces == "" {
+		mapper.namespaces = conf.NamespacesStrip
+	}
+	for _, f := range mapping.Fields {
+		field := outboundField{ignore: f.Ignore}
+		if f.Source == conf.OutboundSourceDeleted {
+			field.deleted = true
+		} else {
+			part, err := conf.ParseEntityPath(f.Source)
+			if err != nil {
+				return nil, err
+			}
+			field.part = part
+		}
+		if !f.Ignore {
+			if f.Path == "" {
+				return nil, fmt.Errorf("mapping of %s has no path", f.Source)
+			}
+			field.path = strings.Split(f.Path, ".")
+		}
+		mapper.fields = append(mapper.fields, field)
+	}
+	return mapper, nil
+}
+
+// Map returns the message value of the entity. Mapped fields are written to their path, and unmapped id, deleted,
+// props and refs are added by name unless dropUnmapped is set. Mapped fields without value are left out. Props
+// are added before refs, and neither replaces a mapped field.
+func (mapper *OutboundMapper) Map(entity *Entity, ctx *Context) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	usedProps := make(map[string]bool)
+	usedRefs := make(map[string]bool)
+	idUsed, deletedUsed := false, false
+
+	for _, f := range mapper.fields {
+		var value interface{}
+		if f.deleted {
+			deletedUsed = true
+			value = entity.IsDeleted
+		} else {
+			name, v, ok := entityPathRaw(entity, f.part)
+			switch f.part.Source {
+			case conf.KeySourceId:
+				idUsed = true
+			case conf.KeySourceProps:
+				usedProps[name] = true
+			case conf.KeySourceRefs:
+				usedRefs[name] = true
+			}
+			if !ok {
+				continue
+			}
+			value = v
+			if f.part.Source != conf.KeySourceProps {
+				value = mapper.value(v, ctx)
+			}
+		}
+		if f.ignore {
+			continue
+		}
+		if err := setPath(out, f.path, value); err != nil {
+			return nil, fmt.Errorf("entity %s could not be mapped: %w", entity.ID, err)
+		}
+	}
+
+	if mapper.dropUnmapped {
+		return out, nil
+	}
+	add := func(name string, value interface{}) {
+		if _, exists := out[name]; !exists {
+			out[name] = value
+		}
+	}
+	if !idUsed {
+		add("id", mapper.value(entity.ID, ctx))
+	}
+	if !deletedUsed {
+		add("deleted", entity.IsDeleted)
+	}
+
+	// unmapped props and refs that get the same name, like ns0:name and ns1:name when stripped, keep their
+	// prefix, so neither of them is dropped
+	names := make(map[string]int)
+	for k := range entity.Properties {
+		if !usedProps[k] {
+			names[mapper.name(k, ctx)]++
+		}
+	}
+	for k := range entity.References {
+		if !usedRefs[k] {
+			names[mapper.name(k, ctx)]++
+		}
+	}
+	name := func(k string) string {
+		if n := mapper.name(k, ctx); names[n] == 1 {
+			return n
+		}
+		return k
+	}
+	for k, v := range entity.Properties {
+		if !usedProps[k] {
+			add(name(k), v)
+		}
+	}
+	for k, v := range entity.References {
+		if !usedRefs[k] {
+			add(name(k), mapper.value(v, ctx))
+		}
+	}
+	return out, nil
+}
+
+func (mapper *OutboundMapper) name(name string, ctx *Context) string {
+	switch mapper.namespaces {
+	case conf.NamespacesExpand:
+		return ExpandNamespace(name, ctx)
+	case conf.NamespacesKeep:
+		return name
+	default:
+		return StripNamespace(name)
+	}
+}
+
+// value applies the namespace handling to id and reference values.
+func (mapper *OutboundMapper) value(v interface{}, ctx *Context) interface{} {
+	switch val := v.(type) {
+	case string:
+		return mapper.name(val, ctx)
+	case []string:
+		result := make([]interface{}, len(val))
+		for i, s := range val {
+			result[i] = mapper.name(s, ctx)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, item := range val {
+			result[i] = mapper.value(item, ctx)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+func setPath(out map[string]interface{}, path []string, value interface{}) error {
+	current := out
+	for i, segment := range path[:len(path)-1] {
+		next, exists := current[segment]
+		if !exists {
+			m := make(map[string]interface{})
+			current[segment] = m
+			current = m
+			continue
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("path %s conflicts with the value at %s", strings.Join(path, "."), strings.Join(path[:i+1], "."))
+		}
+		current = m
+	}
+	last := path[len(path)-1]
+	if _, exists := current[last]; exists {
+		return fmt.Errorf("path %s is mapped more than once", strings.Join(path, "."))
+	}
+	current[last] = value
+	return nil
+}
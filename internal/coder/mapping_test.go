@@ -0,0 +1,114 @@
+package coder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/franela/goblin"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+func TestOutboundMapper(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("An OutboundMapper", func() {
+		ctx := &Context{Namespaces: map[string]interface{}{"ns0": "http://data.example.io/customer/"}}
+		entity := NewEntity()
+		entity.ID = "ns0:customer-1"
+		entity.Properties["ns0:name"] = "Bob"
+		entity.Properties["ns0:age"] = 42.0
+		entity.References["ns0:country"] = "ns0:norway"
+
+		mapped := func(mapping *conf.OutboundMapping) map[string]interface{} {
+			m, err := NewOutboundMapper(mapping)
+			g.Assert(err).IsNil()
+			result, err := m.Map(entity, ctx)
+			g.Assert(err).IsNil()
+			return result
+		}
+
+		g.It("should strip namespaces by default", func() {
+			result := mapped(&conf.OutboundMapping{})
+			g.Assert(result["id"]).Eql("customer-1")
+			g.Assert(result["deleted"]).Eql(false)
+			g.Assert(result["name"]).Eql("Bob")
+			g.Assert(result["country"]).Eql("norway")
+		})
+		g.It("should expand namespaces", func() {
+			result := mapped(&conf.OutboundMapping{Namespaces: conf.NamespacesExpand})
+			g.Assert(result["id"]).Eql("http://data.example.io/customer/customer-1")
+			g.Assert(result["http://data.example.io/customer/name"]).Eql("Bob")
+			g.Assert(result["http://data.example.io/customer/country"]).Eql("http://data.example.io/customer/norway")
+		})
+		g.It("should keep namespaces", func() {
+			result := mapped(&conf.OutboundMapping{Namespaces: conf.NamespacesKeep})
+			g.Assert(result["id"]).Eql("ns0:customer-1")
+			g.Assert(result["ns0:name"]).Eql("Bob")
+		})
+		g.It("should write mapped fields to nested paths", func() {
+			result := mapped(&conf.OutboundMapping{Fields: []*conf.OutboundField{
+				{Source: "id", Path: "customerId"},
+				{Source: "props:ns0:name", Path: "customer.name"},
+				{Source: "refs:country", Path: "customer.address.country"},
+			}})
+			raw, _ := json.Marshal(result)
+			g.Assert(string(raw)).Eql(`{"age":42,"customer":{"address":{"country":"norway"},"name":"Bob"},` +
+				`"customerId":"customer-1","deleted":false}`)
+		})
+		g.It("should drop unmapped and ignored fields", func() {
+			result := mapped(&conf.OutboundMapping{DropUnmapped: true, Fields: []*conf.OutboundField{
+				{Source: "props:name", Path: "name"},
+				{Source: "props:ns0:missing", Path: "missing"},
+				{Source: "deleted", Path: "removed"},
+			}})
+			g.Assert(result).Eql(map[string]interface{}{"name": "Bob", "removed": false})
+
+			result = mapped(&conf.OutboundMapping{Fields: []*conf.OutboundField{
+				{Source: "props:ns0:age", Ignore: true},
+			}})
+			_, ok := result["age"]
+			g.Assert(ok).IsFalse("ignored props should not be added")
+			g.Assert(result["name"]).Eql("Bob")
+		})
+		g.It("should fail on conflicting paths", func() {
+			m, err := NewOutboundMapper(&conf.OutboundMapping{Fields: []*conf.OutboundField{
+				{Source: "props:ns0:name", Path: "customer"},
+				{Source: "props:ns0:age", Path: "customer.age"},
+			}})
+			g.Assert(err).IsNil()
+			_, err = m.Map(entity, ctx)
+			g.Assert(err == nil).IsFalse("expected a path conflict")
+		})
+		g.It("should keep the prefix of names that collide", func() {
+			e := NewEntity()
+			e.ID = "ns0:customer-1"
+			e.Properties["ns0:name"] = "Bob"
+			e.Properties["ns1:name"] = "Robert"
+			e.Properties["ns0:age"] = 42.0
+			e.References["ns1:country"] = "ns0:norway"
+			e.References["ns2:age"] = "ns0:adult"
+			m, _ := NewOutboundMapper(&conf.OutboundMapping{})
+			for i := 0; i < 10; i++ {
+				result, err := m.Map(e, ctx)
+				g.Assert(err).IsNil()
+				g.Assert(result).Eql(map[string]interface{}{
+					"id":       "customer-1",
+					"deleted":  false,
+					"ns0:name": "Bob",
+					"ns1:name": "Robert",
+					"ns0:age":  42.0,
+					"ns2:age":  "adult",
+					"country":  "norway",
+				})
+			}
+		})
+		g.It("should strip props without namespace", func() {
+			e := NewEntity()
+			e.ID = "customer-2"
+			e.Properties["name"] = "Alice"
+			stripped := e.StrippedMap()
+			g.Assert(stripped["id"]).Eql("customer-2")
+			g.Assert(stripped["props"].(map[string]interface{})["name"]).Eql("Alice")
+		})
+	})
+}
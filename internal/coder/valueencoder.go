@@ -0,0 +1,255 @@
+package coder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/linkedin/goavro/v2"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+	"github.com/riferrei/srclient"
+)
+
+// ValueEncoder turns an entity received by a producer dataset into a kafka message value.
+type ValueEncoder interface {
+	Encode(entity *Entity, ctx *Context) ([]byte, error)
+}
+
+func NewValueEncoder(config *conf.ProducerConfig) (ValueEncoder, error) {
+	var mapper *OutboundMapper
+	if config.Mapping != nil {
+		var err error
+		if mapper, err = NewOutboundMapper(config.Mapping); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ValueEncoder != nil {
+		switch *config.ValueEncoder {
+		case "avro":
+			if config.SchemaRegistry != nil && config.SchemaRegistry.Location != "" {
+				subject := config.Topic + "-value"
+				schemaFile := ""
+				if config.AvroSchema != nil {
+					if config.AvroSchema.Subject != "" {
+						subject = config.AvroSchema.Subject
+					}
+					schemaFile = config.AvroSchema.SchemaFile
+				}
+				return &AvroEncoder{
+					client:     srclient.CreateSchemaRegistryClient(config.SchemaRegistry.Location),
+					subject:    subject,
+					schemaFile: schemaFile,
+					mapper:     mapper,
+				}, nil
+			}
+			return nil, fmt.Errorf("avro encoder requires schemaRegistry.location."+
+				" configured schemaRegistry: %+v", config.SchemaRegistry)
+		case "protobuf":
+			if config.ProtobufSchema != nil &&
+				config.ProtobufSchema.FileName != "" &&
+				config.ProtobufSchema.Type != "" &&
+				config.ProtobufSchema.Path != "" {
+				md, err := config.ProtobufSchema.Load()
+				if err != nil {
+					return nil, err
+				}
+				return GenericProtoEncoder{messageDescriptor: md, mapper: mapper}, nil
+			}
+			return nil, fmt.Errorf("protobuf encoder requires protobufSchema.path, type and fileName."+
+				" configured protobufSchema: %+v", config.ProtobufSchema)
+		case "json":
+		default:
+			return nil, fmt.Errorf("unsupported valueEncoder %q", *config.ValueEncoder)
+		}
+	}
+	return JsonEncoder{stripProps: config.StripProps, mapper: mapper}, nil
+}
+
+// JsonEncoder writes the entity as is, stripped, or shaped by the outbound mapping if one is configured.
+type JsonEncoder struct {
+	stripProps bool
+	mapper     *OutboundMapper
+}
+
+func (encoder JsonEncoder) Encode(entity *Entity, ctx *Context) ([]byte, error) {
+	if encoder.mapper != nil {
+		mapped, err := encoder.mapper.Map(entity, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(mapped)
+	}
+	if encoder.stripProps {
+		return entity.StripProps()
+	}
+	entity.Context = ctx.Namespaces
+	return json.Marshal(entity)
+}
+
+// AvroEncoder writes the stripped entity in confluent wire format, using the latest schema of the
+// configured subject. Record fields are filled from the stripped props, and from id, deleted and props.
+// With an outbound mapping, record fields are filled from the top level fields of the mapped value instead.
+type AvroEncoder struct {
+	client     srclient.ISchemaRegistryClient
+	subject    string
+	schemaFile string
+	mapper     *OutboundMapper
+
+	lock     sync.Mutex
+	schemaID int
+	codec    *goavro.Codec
+	fields   []string
+}
+
+func (encoder *AvroEncoder) Encode(entity *Entity, ctx *Context) ([]byte, error) {
+	if err := encoder.resolveSchema(); err != nil {
+		return nil, err
+	}
+
+	record := make(map[string]interface{})
+	if encoder.mapper != nil {
+		mapped, err := encoder.mapper.Map(entity, ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range encoder.fields {
+			if v, ok := mapped[f]; ok {
+				record[f] = v
+			}
+		}
+	} else {
+		stripped := entity.StrippedMap()
+		props := stripped["props"].(map[string]interface{})
+		for _, f := range encoder.fields {
+			if v, ok := props[f]; ok {
+				record[f] = v
+			} else if v, ok := stripped[f]; ok {
+				record[f] = v
+			}
+		}
+	}
+	textual, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := encoder.codec.NativeFromTextual(textual)
+	if err != nil {
+		return nil, fmt.Errorf("entity %s does not match avro schema for %s: %w", entity.ID, encoder.subject, err)
+	}
+
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(encoder.schemaID))
+	return encoder.codec.BinaryFromNative(header, native)
+}
+
+// resolveSchema looks up the subject schema on first use, and registers the schema file if the
+// subject is unknown. Failed lookups are retried on the next call.
+func (encoder *AvroEncoder) resolveSchema() error {
+	encoder.lock.Lock()
+	defer encoder.lock.Unlock()
+	if encoder.codec != nil {
+		return nil
+	}
+
+	schema, err := encoder.client.GetLatestSchema(encoder.subject)
+	if err != nil || schema == nil {
+		if encoder.schemaFile == "" {
+			return fmt.Errorf("could not find avro schema for subject %s: %v", encoder.subject, err)
+		}
+		raw, err := os.ReadFile(encoder.schemaFile)
+		if err != nil {
+			return err
+		}
+		schema, err = encoder.client.CreateSchema(encoder.subject, string(raw), srclient.Avro)
+		if err != nil {
+			return fmt.Errorf("could not register avro schema for subject %s: %w", encoder.subject, err)
+		}
+	}
+
+	// the standard json codec accepts union values without type wrappers, which matches entity props
+	codec, err := goavro.NewCodecForStandardJSONFull(schema.Schema())
+	if err != nil {
+		return err
+	}
+	spec := struct {
+		Fields []struct {
+			Name string `json:"name"`
+		} `json:"fields"`
+	}{}
+	if err = json.Unmarshal([]byte(schema.Schema()), &spec); err != nil {
+		return err
+	}
+	fields := make([]string, 0, len(spec.Fields))
+	for _, f := range spec.Fields {
+		fields = append(fields, f.Name)
+	}
+	encoder.fields = fields
+	encoder.schemaID = schema.ID()
+	encoder.codec = codec
+	return nil
+}
+
+// GenericProtoEncoder maps the stripped entity props onto a dynamic message of the configured type. Props are
+// matched by json name or field name, and converted using the protobuf json mapping. If the message has an id
+// field that is not given as a prop, it gets the stripped entity id. With an outbound mapping, the top level
+// fields of the mapped value are used instead.
+type GenericProtoEncoder struct {
+	messageDescriptor *desc.MessageDescriptor
+	mapper            *OutboundMapper
+}
+
+func (encoder GenericProtoEncoder) Encode(entity *Entity, ctx *Context) ([]byte, error) {
+	var values map[string]interface{}
+	if encoder.mapper != nil {
+		mapped, err := encoder.mapper.Map(entity, ctx)
+		if err != nil {
+			return nil, err
+		}
+		values = mapped
+	} else {
+		stripped := entity.StrippedMap()
+		values = stripped["props"].(map[string]interface{})
+		if _, ok := values["id"]; !ok && encoder.messageDescriptor.FindFieldByName("id") != nil {
+			values["id"] = stripped["id"]
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	m := dynamic.NewMessage(encoder.messageDescriptor)
+	var errs []error
+	for _, k := range keys {
+		fd := m.FindFieldDescriptorByJSONName(k)
+		if fd == nil {
+			fd = m.FindFieldDescriptorByName(k)
+		}
+		if fd == nil {
+			errs = append(errs, fmt.Errorf("no field %s in %s", k, encoder.messageDescriptor.GetFullyQualifiedName()))
+			continue
+		}
+		raw, err := json.Marshal(map[string]interface{}{fd.GetJSONName(): values[k]})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field %s: %w", k, err))
+			continue
+		}
+		if err = m.UnmarshalMergeJSON(raw); err != nil {
+			errs = append(errs, fmt.Errorf("field %s: %w", k, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("entity %s could not be encoded as %s: %w",
+			entity.ID, encoder.messageDescriptor.GetFullyQualifiedName(), errors.Join(errs...))
+	}
+	return m.Marshal()
+}
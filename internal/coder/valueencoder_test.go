@@ -0,0 +1,128 @@
+package coder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/franela/goblin"
+	"github.com/riferrei/srclient"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+func TestValueEncoder(t *testing.T) {
+	g := goblin.Goblin(t)
+	g.Describe("An avro ValueEncoder", func() {
+		resourcesTestPath := "../../resources/test"
+		overridePath := os.Getenv("RESOURCES_TEST_DIR")
+		if overridePath != "" {
+			resourcesTestPath = overridePath
+		}
+		entity := NewEntity()
+		entity.ID = "ns0:Bob"
+		entity.IsDeleted = true
+		entity.Properties["ns0:name"] = "Bob"
+		entity.Properties["ns0:kind"] = "Cat"
+		entity.Properties["ns0:age"] = 3.0
+		entity.Properties["ns0:dead"] = true
+
+		g.It("should register the schema file and write confluent wire format", func() {
+			client := srclient.CreateMockSchemaRegistryClient("http://registry")
+			enc := &AvroEncoder{
+				client:     client,
+				subject:    "pets-value",
+				schemaFile: path.Join(resourcesTestPath, "/avroschema/Pet.avsc"),
+			}
+			res, err := enc.Encode(entity, &Context{})
+			g.Assert(err).IsNil()
+			g.Assert(res[0]).Eql(byte(0))
+
+			schema, err := client.GetLatestSchema("pets-value")
+			g.Assert(err).IsNil()
+			g.Assert(int(binary.BigEndian.Uint32(res[1:5]))).Eql(schema.ID())
+
+			native, _, err := schema.Codec().NativeFromBinary(res[5:])
+			g.Assert(err).IsNil()
+			g.Assert(native).Eql(map[string]interface{}{"name": "Bob", "kind": "Cat", "age": int32(3), "dead": true})
+		})
+		g.It("should report entities not matching the schema", func() {
+			enc := &AvroEncoder{
+				client:     srclient.CreateMockSchemaRegistryClient("http://registry"),
+				subject:    "pets-value",
+				schemaFile: path.Join(resourcesTestPath, "/avroschema/Pet.avsc"),
+			}
+			broken := NewEntity()
+			broken.ID = "ns0:Tom"
+			broken.Properties["ns0:name"] = "Tom"
+			_, err := enc.Encode(broken, &Context{})
+			g.Assert(err == nil).IsFalse()
+		})
+		g.It("should fail without a registered schema or schema file", func() {
+			enc := &AvroEncoder{
+				client:  srclient.CreateMockSchemaRegistryClient("http://registry"),
+				subject: "pets-value",
+			}
+			_, err := enc.Encode(entity, &Context{})
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+	g.Describe("A protobuf ValueEncoder", func() {
+		resourcesTestPath := "../../resources/test"
+		overridePath := os.Getenv("RESOURCES_TEST_DIR")
+		if overridePath != "" {
+			resourcesTestPath = overridePath
+		}
+		d := "protobuf"
+		schema := &conf.ProtobufSchema{
+			Path:     path.Join(resourcesTestPath, "/protoschema"),
+			FileName: "person.proto",
+			Type:     "testdata.Person",
+		}
+		enc, err := NewValueEncoder(&conf.ProducerConfig{ValueEncoder: &d, ProtobufSchema: schema})
+		g.It("should encode entity props as protobuf message", func() {
+			g.Assert(err).IsNil()
+			entity := NewEntity()
+			entity.ID = "ns0:test"
+			entity.Properties["ns0:name"] = "test"
+			entity.Properties["ns0:age"] = 2.0
+			entity.Properties["ns0:phones"] = []interface{}{
+				map[string]interface{}{"number": "555-100-200", "type": "HOME"},
+			}
+			entity.Properties["ns0:address"] = map[string]interface{}{"street": "Tøyengata", "houseNumber": 601.0}
+			entity.Properties["ns0:lastUpdated"] = "2022-04-27T13:59:01Z"
+			res, err := enc.Encode(entity, &Context{})
+			g.Assert(err).IsNil()
+
+			dec, err := NewDecoder(&conf.ConsumerConfig{ValueDecoder: &d, ProtobufSchema: schema})
+			g.Assert(err).IsNil()
+			decoded, err := dec.Decode(&kafka.Message{Value: res})
+			g.Assert(err).IsNil()
+			resMap := map[string]interface{}{}
+			g.Assert(json.Unmarshal(decoded, &resMap)).IsNil()
+			g.Assert(resMap).Eql(map[string]interface{}{
+				"name":        "test",
+				"age":         2.0,
+				"phones":      []interface{}{map[string]interface{}{"number": "555-100-200", "type": "HOME"}},
+				"address":     map[string]interface{}{"street": "Tøyengata", "houseNumber": 601.0},
+				"lastUpdated": "2022-04-27T13:59:01Z",
+			})
+		})
+		g.It("should report unknown fields and bad values", func() {
+			entity := NewEntity()
+			entity.ID = "ns0:test"
+			entity.Properties["ns0:name"] = "test"
+			entity.Properties["ns0:shoeSize"] = 44.0
+			entity.Properties["ns0:age"] = "old"
+			_, err := enc.Encode(entity, &Context{})
+			g.Assert(err == nil).IsFalse()
+			g.Assert(strings.Contains(err.Error(), "ns0:test")).IsTrue(err.Error())
+			g.Assert(strings.Contains(err.Error(), "no field shoeSize")).IsTrue(err.Error())
+			g.Assert(strings.Contains(err.Error(), "field age")).IsTrue(err.Error())
+		})
+	})
+}
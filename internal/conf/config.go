@@ -29,14 +29,39 @@ func NewEnv() *Env {
 		brokers = strings.Split(brokers[0], ",")
 	}
 
+	security := &KafkaSecurityConfig{
+		Protocol:      strings.ToUpper(viper.GetString("KAFKA_SECURITY_PROTOCOL")),
+		SaslMechanism: strings.ToUpper(viper.GetString("KAFKA_SASL_MECHANISM")),
+		SaslUsername:  viper.GetString("KAFKA_SASL_USERNAME"),
+		SaslPassword:  viper.GetString("KAFKA_SASL_PASSWORD"),
+		CaFile:        viper.GetString("KAFKA_TLS_CA_FILE"),
+		CertFile:      viper.GetString("KAFKA_TLS_CERT_FILE"),
+		KeyFile:       viper.GetString("KAFKA_TLS_KEY_FILE"),
+	}
+	if security.Protocol == "" {
+		// derive the protocol from what is configured, SASL is always combined with TLS unless set explicitly
+		switch {
+		case security.SaslMechanism != "":
+			security.Protocol = "SASL_SSL"
+		case security.CaFile != "" || security.CertFile != "":
+			security.Protocol = "SSL"
+		default:
+			security.Protocol = "PLAINTEXT"
+		}
+	}
+
 	return &Env{
-		Logger:          logger,
-		Env:             profile,
-		Port:            viper.GetString("SERVER_PORT"),
-		ConfigLocation:  viper.GetString("CONFIG_LOCATION"),
-		RefreshInterval: viper.GetString("CONFIG_REFRESH_INTERVAL"),
-		ServiceName:     viper.GetString("SERVICE_NAME"),
-		KafkaBrokers:    brokers,
+		Logger:                 logger,
+		Env:                    profile,
+		Port:                   viper.GetString("SERVER_PORT"),
+		ConfigLocation:         viper.GetString("CONFIG_LOCATION"),
+		RefreshInterval:        viper.GetString("CONFIG_REFRESH_INTERVAL"),
+		ServiceName:            viper.GetString("SERVICE_NAME"),
+		KafkaBrokers:           brokers,
+		KafkaSecurity:          security,
+		ValidateSchemaRegistry: viper.GetBool("CONFIG_VALIDATE_SCHEMA_REGISTRY"),
+		ShutdownTimeout:        viper.GetDuration("SHUTDOWN_TIMEOUT"),
+		StateDir:               viper.GetString("STATE_DIR"),
 		Auth: &AuthConfig{
 			WellKnown:     viper.GetString("TOKEN_WELL_KNOWN"),
 			Audience:      viper.GetString("TOKEN_AUDIENCE"),
@@ -55,6 +80,8 @@ func parseEnv(env string, logger *zap.SugaredLogger) {
 	viper.SetDefault("LOG_LEVEL", "INFO")
 	viper.SetDefault("CONFIG_REFRESH_INTERVAL", "@every 60s")
 	viper.SetDefault("SERVICE_NAME", "kafka-datalayer")
+	viper.SetDefault("SHUTDOWN_TIMEOUT", "30s")
+	viper.SetDefault("STATE_DIR", ".state")
 	viper.AutomaticEnv()
 
 	viper.SetDefault("CONFIG_LOCATION", fmt.Sprintf("file://%s", ".config.json"))
@@ -7,14 +7,101 @@ type KafkaConfig struct {
 }
 
 type ProducerConfig struct {
-	Dataset       string         `json:"dataset"`
-	Topic         string         `json:"topic"`
-	CreateTopic   bool           `json:"createTopic"`
-	TopicSettings *TopicSettings `json:"topicSettings"`
-	StripProps    bool           `json:"stripProps"`
-	Key           *string        `json:"key"`
+	Dataset        string          `json:"dataset"`
+	Topic          string          `json:"topic"`
+	CreateTopic    bool            `json:"createTopic"`
+	TopicSettings  *TopicSettings  `json:"topicSettings"`
+	StripProps     bool            `json:"stripProps"`
+	Key            *string         `json:"key"`
+	KeyMissing     string          `json:"keyMissing"`
+	ValueEncoder   *string         `json:"valueEncoder"`
+	SchemaRegistry *SchemaRegistry `json:"schemaRegistry"`
+	AvroSchema     *AvroSchema     `json:"avroSchema"`
+	ProtobufSchema *ProtobufSchema `json:"protobufSchema"`
+	// writer settings, the kafka-go defaults are used when they are not set
+	BatchSize    int    `json:"batchSize"`
+	BatchTimeout string `json:"batchTimeout"`
+	RequiredAcks string `json:"requiredAcks"`
+	Compression  string `json:"compression"`
+	MaxAttempts  int    `json:"maxAttempts"`
+	// DeletedAsTombstone writes deleted entities as messages without value, for compacted topics
+	DeletedAsTombstone bool `json:"deletedAsTombstone"`
+	// Headers are added to each message
+	Headers []*HeaderMapping `json:"headers"`
+	// PropagateHeaders turns kafka_header.* props, as read by consumers with includeHeaders, back into headers
+	PropagateHeaders bool `json:"propagateHeaders"`
+	// Transactional writes each request in a kafka transaction, so it is committed or aborted as a whole
+	Transactional bool `json:"transactional"`
+	// TransactionalId defaults to <service name>-<dataset>, and must be unique for each running instance
+	TransactionalId string `json:"transactionalId"`
+	// TransactionTimeout is how long a transaction may run before the broker aborts it, like "5m". It defaults to
+	// the librdkafka default of 60s, and must cover the time it takes to send the largest request
+	TransactionTimeout string `json:"transactionTimeout"`
+	// FullSync decides how full syncs from the datahub are written, they are treated as normal writes if not set
+	FullSync *FullSyncSettings `json:"fullSync"`
+	// Mapping shapes the message value, instead of writing the entity as is or with stripProps
+	Mapping *OutboundMapping `json:"mapping"`
 }
 
+type OutboundMapping struct {
+	// Namespaces is one of strip (default), expand or keep, and applies to the names of unmapped fields,
+	// and to id and reference values
+	Namespaces string `json:"namespaces"`
+	// DropUnmapped leaves out id, deleted, props and refs without a field mapping
+	DropUnmapped bool             `json:"dropUnmapped"`
+	Fields       []*OutboundField `json:"fields"`
+}
+
+type OutboundField struct {
+	// Source is id, deleted, or an entity path like "props:ns0:name" or "refs:ns0:owner"
+	Source string `json:"source"`
+	// Path is the dot separated output path, like "customer.name"
+	Path string `json:"path"`
+	// Ignore leaves the source out of the message
+	Ignore bool `json:"ignore"`
+}
+
+const (
+	NamespacesStrip  = "strip"
+	NamespacesExpand = "expand"
+	NamespacesKeep   = "keep"
+
+	OutboundSourceDeleted = "deleted"
+)
+
+type FullSyncSettings struct {
+	// Strategy is one of markers, versionedTopic or tombstones
+	Strategy string `json:"strategy"`
+	// AliasTopic receives the name of the current versioned topic, keyed by the configured topic
+	AliasTopic string `json:"aliasTopic"`
+}
+
+const (
+	FullSyncMarkers        = "markers"
+	FullSyncVersionedTopic = "versionedTopic"
+	FullSyncTombstones     = "tombstones"
+)
+
+type HeaderMapping struct {
+	// Name of the kafka header
+	Name string `json:"name"`
+	// Source is one of static, id, dataset, property, correlationId or timestamp
+	Source string `json:"source"`
+	// Value is the header value of static headers
+	Value string `json:"value"`
+	// Path is the entity path of property headers, like "props:ns0:customerId"
+	Path string `json:"path"`
+}
+
+const (
+	HeaderSourceStatic        = "static"
+	HeaderSourceId            = "id"
+	HeaderSourceDataset       = "dataset"
+	HeaderSourceProperty      = "property"
+	HeaderSourceCorrelationId = "correlationId"
+	HeaderSourceTimestamp     = "timestamp"
+)
+
 type TopicSettings struct {
 	Partitions int                `json:"partitions"`
 	Replicas   int                `json:"replicas"`
@@ -25,6 +112,13 @@ type SchemaRegistry struct {
 	Location string `json:"location"`
 }
 
+type AvroSchema struct {
+	// registry subject to look up the schema in, defaults to <topic>-value
+	Subject string `json:"subject"`
+	// optional avsc file on disk, registered under the subject if the registry does not know it yet
+	SchemaFile string `json:"schemaFile"`
+}
+
 type ProtobufSchema struct {
 	// path on disk where protobuf schema files are located
 	Path string `json:"path"`
@@ -40,16 +134,48 @@ type ConsumerConfig struct {
 	GroupId             string          `json:"groupId"`
 	ValueDecoder        *string         `json:"valueDecoder"`
 	Position            string          `json:"position"`
+	Stateless           bool            `json:"stateless"`
 	NameSpace           string          `json:"nameSpace"`
 	BaseNameSpace       string          `json:"baseNameSpace"`
 	IncludeHeaders      bool            `json:"includeHeaders"`
 	EntityIdConstructor string          `json:"entityIdConstructor"`
 	Types               []string        `json:"types"`
+	TypePath            string          `json:"typePath"`
 	FieldMappings       []*FieldMapping `json:"fieldMappings"`
 	SchemaRegistry      *SchemaRegistry `json:"schemaRegistry"`
 	ProtobufSchema      *ProtobufSchema `json:"protobufSchema"`
+	OnDecodeError       string          `json:"onDecodeError"`
+	DeadLetterTopic     string          `json:"deadLetterTopic"`
+	IsolationLevel      string          `json:"isolationLevel"`
+	IdTemplate          string          `json:"idTemplate"`
+	IdMissing           string          `json:"idMissing"`
+
+	// nesting keeps sub objects as nested entities, their props can get namespaces of their own
+	Nesting          string            `json:"nesting"`
+	NestedNameSpaces map[string]string `json:"nestedNameSpaces"`
+
+	// what happens when a field mapping can not transform or convert a value
+	OnMappingError string `json:"onMappingError"`
 }
 
+const (
+	NestingFlatten  = "flatten"
+	NestingEntities = "entities"
+)
+
+const (
+	OnDecodeErrorFail       = "fail"
+	OnDecodeErrorSkip       = "skip"
+	OnDecodeErrorDeadLetter = "deadLetter"
+)
+
+const (
+	OnMappingErrorFail       = "fail"
+	OnMappingErrorSkip       = "skip"
+	OnMappingErrorDeadLetter = "deadLetter"
+	OnMappingErrorDropField  = "dropField"
+)
+
 type FieldMapping struct {
 	Path              string `json:"path"`
 	FieldName         string `json:"fieldName"`
@@ -59,4 +185,40 @@ type FieldMapping struct {
 	IsReference       bool   `json:"isReference"`
 	ReferenceTemplate string `json:"referenceTemplate"`
 	IgnoreField       bool   `json:"ignoreField"`
+	AsEntities        bool   `json:"asEntities"`
+	ElementIdPath     string `json:"elementIdPath"`
+
+	// transforms are applied to the value in order, before it is converted to the datatype
+	Transforms     []*Transform `json:"transforms"`
+	Datatype       string       `json:"datatype"`
+	DatetimeFormat string       `json:"datetimeFormat"`
+}
+
+const (
+	DatatypeString   = "string"
+	DatatypeInt      = "int"
+	DatatypeFloat    = "float"
+	DatatypeBool     = "bool"
+	DatatypeDatetime = "datetime"
+	DatatypeUUID     = "uuid"
+
+	DatetimeEpochMillis  = "epochMillis"
+	DatetimeEpochSeconds = "epochSeconds"
+)
+
+type Transform struct {
+	Type        string                 `json:"type"`
+	Pattern     string                 `json:"pattern"`
+	Replacement string                 `json:"replacement"`
+	Value       interface{}            `json:"value"`
+	Values      map[string]interface{} `json:"values"`
 }
+
+const (
+	TransformLowercase = "lowercase"
+	TransformUppercase = "uppercase"
+	TransformTrim      = "trim"
+	TransformReplace   = "replace"
+	TransformDefault   = "default"
+	TransformMap       = "map"
+)
@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"time"
+
 	"go.uber.org/zap"
 )
 
@@ -12,7 +14,14 @@ type Env struct {
 	RefreshInterval string
 	ServiceName     string
 	KafkaBrokers    []string
+	KafkaSecurity   *KafkaSecurityConfig
 	Auth            *AuthConfig
+	// ValidateSchemaRegistry rejects configs with schema registries that cannot be reached
+	ValidateSchemaRegistry bool
+	// ShutdownTimeout bounds how long running reads and writes are waited for on shutdown
+	ShutdownTimeout time.Duration
+	// StateDir is where producers keep local state, such as the keys tracked for full syncs
+	StateDir string
 }
 
 type AuthConfig struct {
@@ -23,3 +32,23 @@ type AuthConfig struct {
 	IssuerAuth0   string
 	Middleware    string
 }
+
+type KafkaSecurityConfig struct {
+	Protocol      string
+	SaslMechanism string
+	SaslUsername  string
+	SaslPassword  string
+	CaFile        string
+	CertFile      string
+	KeyFile       string
+}
+
+// UsesTLS is true when the security protocol is SSL or SASL_SSL.
+func (security *KafkaSecurityConfig) UsesTLS() bool {
+	return security.Protocol == "SSL" || security.Protocol == "SASL_SSL"
+}
+
+// UsesSASL is true when the security protocol is SASL_PLAINTEXT or SASL_SSL.
+func (security *KafkaSecurityConfig) UsesSASL() bool {
+	return security.Protocol == "SASL_PLAINTEXT" || security.Protocol == "SASL_SSL"
+}
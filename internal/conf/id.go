@@ -0,0 +1,67 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	IdSourceValue     = "value"
+	IdSourceKafkaKey  = "kafkaKey"
+	IdSourceHeader    = "header"
+	IdSourcePartition = "partition"
+	IdSourceOffset    = "offset"
+
+	IdMissingKafkaKey        = "kafkaKey"
+	IdMissingPartitionOffset = "partitionOffset"
+	IdMissingSkip            = "skip"
+)
+
+// IdTemplate is the parsed form of ConsumerConfig.IdTemplate.
+type IdTemplate struct {
+	Parts []IdPart
+}
+
+// IdPart is either a literal, or a value looked up in the message. Name is the gjson path into the message
+// value, or the header name.
+type IdPart struct {
+	Literal string
+	Source  string
+	Name    string
+}
+
+// ParseIdTemplate parses templates combining literals and message values in braces, like
+// "{tenant}-{order.number}". A placeholder is "kafkaKey", "partition", "offset", "header:<name>", or a gjson
+// path into the message value, optionally written as "value:<path>".
+func ParseIdTemplate(template string) (*IdTemplate, error) {
+	segments, err := splitTemplate(template)
+	if err != nil {
+		return nil, fmt.Errorf("id template %q: %w", template, err)
+	}
+	parts := make([]IdPart, 0, len(segments))
+	placeholders := 0
+	for _, s := range segments {
+		if !s.placeholder {
+			parts = append(parts, IdPart{Literal: s.text})
+			continue
+		}
+		placeholders++
+		switch s.text {
+		case IdSourceKafkaKey, IdSourcePartition, IdSourceOffset:
+			parts = append(parts, IdPart{Source: s.text})
+			continue
+		}
+		source, name, found := strings.Cut(s.text, ":")
+		if !found || (source != IdSourceHeader && source != IdSourceValue) {
+			source, name = IdSourceValue, s.text
+		}
+		if name == "" {
+			return nil, fmt.Errorf("id template %q has an empty placeholder", template)
+		}
+		parts = append(parts, IdPart{Source: source, Name: name})
+	}
+	if placeholders == 0 {
+		return nil, fmt.Errorf("id template %q has no placeholders, ids would not be unique", template)
+	}
+	return &IdTemplate{Parts: parts}, nil
+}
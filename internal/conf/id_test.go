@@ -0,0 +1,40 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestParseIdTemplate(t *testing.T) {
+	tpl, err := ParseIdTemplate("order/{header:tenant}/{order.number}-{kafkaKey}@{partition}.{offset}/{value:offset}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []IdPart{
+		{Literal: "order/"},
+		{Source: IdSourceHeader, Name: "tenant"},
+		{Literal: "/"},
+		{Source: IdSourceValue, Name: "order.number"},
+		{Literal: "-"},
+		{Source: IdSourceKafkaKey},
+		{Literal: "@"},
+		{Source: IdSourcePartition},
+		{Literal: "."},
+		{Source: IdSourceOffset},
+		{Literal: "/"},
+		{Source: IdSourceValue, Name: "offset"},
+	}
+	if len(tpl.Parts) != len(expected) {
+		t.Fatalf("expected %d parts, got %+v", len(expected), tpl.Parts)
+	}
+	for i := range expected {
+		if tpl.Parts[i] != expected[i] {
+			t.Errorf("part %d: expected %+v, got %+v", i, expected[i], tpl.Parts[i])
+		}
+	}
+
+	for _, invalid := range []string{"", "order", "{order", "x-{}", "{header:}"} {
+		if _, err = ParseIdTemplate(invalid); err == nil {
+			t.Errorf("expected error for id template %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	KeyNone     = ""
+	KeyId       = "id"
+	KeyUUID     = "uuid"
+	KeyTemplate = "template"
+
+	KeySourceId    = "id"
+	KeySourceProps = "props"
+	KeySourceRefs  = "refs"
+
+	KeyMissingFail = "fail"
+	KeyMissingId   = "id"
+	KeyMissingNull = "null"
+)
+
+// Key is the parsed form of ProducerConfig.Key.
+type Key struct {
+	Kind  string
+	Parts []KeyPart
+}
+
+// KeyPart is either a literal, or a value looked up in the entity. Name is the property or reference name,
+// for example "ns0:customerId".
+type KeyPart struct {
+	Literal string
+	Source  string
+	Name    string
+}
+
+// ParseKey supports "id", "uuid", a single entity path like "props:ns0:customerId" or "refs:ns0:customer", and
+// templates combining literals and paths in braces, like "{props:ns0:country}-{props:ns0:customerId}".
+// A nil key means messages are written without key.
+func ParseKey(key *string) (*Key, error) {
+	if key == nil {
+		return &Key{Kind: KeyNone}, nil
+	}
+	switch *key {
+	case KeyId:
+		return &Key{Kind: KeyId}, nil
+	case KeyUUID:
+		return &Key{Kind: KeyUUID}, nil
+	case "":
+		return nil, fmt.Errorf("key must not be empty, omit it to write messages without key")
+	}
+
+	if !strings.Contains(*key, "{") {
+		part, err := ParseEntityPath(*key)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported key %q, must be id, uuid, an entity path or a template: %w", *key, err)
+		}
+		return &Key{Kind: KeyTemplate, Parts: []KeyPart{part}}, nil
+	}
+
+	segments, err := splitTemplate(*key)
+	if err != nil {
+		return nil, fmt.Errorf("key template %q: %w", *key, err)
+	}
+	parts := make([]KeyPart, 0, len(segments))
+	for _, s := range segments {
+		if !s.placeholder {
+			parts = append(parts, KeyPart{Literal: s.text})
+			continue
+		}
+		part, err := ParseEntityPath(s.text)
+		if err != nil {
+			return nil, fmt.Errorf("key template %q: %w", *key, err)
+		}
+		parts = append(parts, part)
+	}
+	return &Key{Kind: KeyTemplate, Parts: parts}, nil
+}
+
+type templateSegment struct {
+	text        string
+	placeholder bool
+}
+
+// splitTemplate splits a template like "{a}-{b}" into literals and the placeholders in braces.
+func splitTemplate(template string) ([]templateSegment, error) {
+	segments := make([]templateSegment, 0)
+	rest := template
+	for rest != "" {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			segments = append(segments, templateSegment{text: rest})
+			break
+		}
+		if start > 0 {
+			segments = append(segments, templateSegment{text: rest[:start]})
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed {")
+		}
+		segments = append(segments, templateSegment{text: rest[start+1 : start+end], placeholder: true})
+		rest = rest[start+end+1:]
+	}
+	return segments, nil
+}
+
+// ParseEntityPath parses a single path into an entity, "id", "props:<name>" or "refs:<name>".
+func ParseEntityPath(path string) (KeyPart, error) {
+	if path == KeySourceId {
+		return KeyPart{Source: KeySourceId}, nil
+	}
+	source, name, ok := strings.Cut(path, ":")
+	if !ok || name == "" || (source != KeySourceProps && source != KeySourceRefs) {
+		return KeyPart{}, fmt.Errorf("invalid path %q, expected id, props:<name> or refs:<name>", path)
+	}
+	return KeyPart{Source: source, Name: name}, nil
+}
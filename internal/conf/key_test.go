@@ -0,0 +1,55 @@
+package conf
+
+import (
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	k, err := ParseKey(nil)
+	if err != nil || k.Kind != KeyNone {
+		t.Errorf("nil key should be no key, got %+v (%v)", k, err)
+	}
+
+	id := "id"
+	k, err = ParseKey(&id)
+	if err != nil || k.Kind != KeyId {
+		t.Errorf("expected id key, got %+v (%v)", k, err)
+	}
+
+	path := "props:ns0:customerId"
+	k, err = ParseKey(&path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Kind != KeyTemplate || len(k.Parts) != 1 || k.Parts[0] != (KeyPart{Source: KeySourceProps, Name: "ns0:customerId"}) {
+		t.Errorf("expected single props path, got %+v", k)
+	}
+
+	template := "{refs:ns0:country}-{props:ns0:customerId}/{id}"
+	k, err = ParseKey(&template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyPart{
+		{Source: KeySourceRefs, Name: "ns0:country"},
+		{Literal: "-"},
+		{Source: KeySourceProps, Name: "ns0:customerId"},
+		{Literal: "/"},
+		{Source: KeySourceId},
+	}
+	if len(k.Parts) != len(expected) {
+		t.Fatalf("expected %d parts, got %+v", len(expected), k.Parts)
+	}
+	for i := range expected {
+		if k.Parts[i] != expected[i] {
+			t.Errorf("part %d: expected %+v, got %+v", i, expected[i], k.Parts[i])
+		}
+	}
+
+	for _, invalid := range []string{"", "customerId", "props:", "{props:ns0:a", "x-{other:a}"} {
+		invalid := invalid
+		if _, err = ParseKey(&invalid); err == nil {
+			t.Errorf("expected error for key %q", invalid)
+		}
+	}
+}
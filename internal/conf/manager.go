@@ -22,6 +22,7 @@ import (
 type ConfigurationManager struct {
 	configLocation      string
 	refreshInterval     string
+	validationOptions   ValidationOptions
 	Datalayer           *KafkaConfig
 	logger              *zap.SugaredLogger
 	State               State
@@ -38,13 +39,19 @@ func NewConfigurationManager(lc fx.Lifecycle, env *Env, providers *security.Toke
 	config := &ConfigurationManager{
 		configLocation:  env.ConfigLocation,
 		refreshInterval: env.RefreshInterval,
-		Datalayer:       &KafkaConfig{},
-		TokenProviders:  providers,
-		logger:          env.Logger.Named("configuration"),
+		validationOptions: ValidationOptions{
+			CheckSchemaRegistry: env.ValidateSchemaRegistry,
+		},
+		Datalayer:      &KafkaConfig{},
+		TokenProviders: providers,
+		logger:         env.Logger.Named("configuration"),
 		State: State{
 			Timestamp: time.Now().Unix(),
 		},
 	}
+	config.validationOptions.Warn = func(e ValidationError) {
+		config.logger.Warn(e.Error())
+	}
 	config.Datalayer = config.Init()
 	/*lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
@@ -82,7 +89,7 @@ func (conf *ConfigurationManager) load() *KafkaConfig {
 		c, err := conf.loadUrl(conf.configLocation)
 		if err != nil {
 			conf.logger.Warn("Unable to parse json into config. Error is: "+err.Error()+". Please check file: "+conf.configLocation, err)
-			return nil
+			return conf.Datalayer
 		}
 		configContent, err = unpackContent(c)
 	} else {
@@ -109,7 +116,20 @@ func (conf *ConfigurationManager) load() *KafkaConfig {
 		config, err := conf.parse(configContent)
 		if err != nil {
 			conf.logger.Warn("Unable to parse json into config. Error is: "+err.Error()+". Please check file: "+conf.configLocation, err)
-			return nil
+			return conf.Datalayer
+		}
+		err = config.Validate(conf.validationOptions)
+		if err != nil {
+			// keep the last good config active, the new one is validated again on the next refresh
+			conf.logger.Warnf("Rejected invalid config from %s, keeping the active config", conf.configLocation)
+			if errs, ok := err.(ValidationErrors); ok {
+				for _, e := range errs {
+					conf.logger.Warn(e.Error())
+				}
+			} else {
+				conf.logger.Warn(err)
+			}
+			return conf.Datalayer
 		}
 
 		conf.Datalayer = config
@@ -188,6 +208,11 @@ func (conf *ConfigurationManager) loadFile(location string) ([]byte, error) {
 }
 
 func (conf *ConfigurationManager) parse(config []byte) (*KafkaConfig, error) {
+	return Parse(config)
+}
+
+// Parse reads a KafkaConfig from json, without validating it.
+func Parse(config []byte) (*KafkaConfig, error) {
 	configuration := &KafkaConfig{}
 	err := json.Unmarshal(config, configuration)
 	return configuration, err
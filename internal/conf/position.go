@@ -0,0 +1,39 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	PositionEarliest  = "earliest"
+	PositionLatest    = "latest"
+	PositionTimestamp = "timestamp"
+)
+
+// Position is the parsed form of ConsumerConfig.Position, and decides where a consumer starts
+// reading when no since token is given.
+type Position struct {
+	Kind      string
+	Timestamp time.Time
+}
+
+// ParsePosition supports "earliest", "latest" and "timestamp:<RFC3339>". An empty position
+// defaults to earliest.
+func ParsePosition(position string) (*Position, error) {
+	switch {
+	case position == "" || position == PositionEarliest:
+		return &Position{Kind: PositionEarliest}, nil
+	case position == PositionLatest:
+		return &Position{Kind: PositionLatest}, nil
+	case strings.HasPrefix(position, PositionTimestamp+":"):
+		ts, err := time.Parse(time.RFC3339, strings.TrimPrefix(position, PositionTimestamp+":"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid position timestamp, expected timestamp:<RFC3339>: %w", err)
+		}
+		return &Position{Kind: PositionTimestamp, Timestamp: ts}, nil
+	default:
+		return nil, fmt.Errorf("unsupported position %q, must be earliest, latest or timestamp:<RFC3339>", position)
+	}
+}
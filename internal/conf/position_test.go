@@ -0,0 +1,34 @@
+package conf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePosition(t *testing.T) {
+	p, err := ParsePosition("")
+	if err != nil || p.Kind != PositionEarliest {
+		t.Errorf("empty position should default to earliest, got %+v (%v)", p, err)
+	}
+
+	p, err = ParsePosition("latest")
+	if err != nil || p.Kind != PositionLatest {
+		t.Errorf("expected latest, got %+v (%v)", p, err)
+	}
+
+	p, err = ParsePosition("timestamp:2022-04-27T13:59:01Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2022, 4, 27, 13, 59, 1, 0, time.UTC)
+	if p.Kind != PositionTimestamp || !p.Timestamp.Equal(expected) {
+		t.Errorf("expected timestamp %v, got %+v", expected, p)
+	}
+
+	if _, err = ParsePosition("timestamp:yesterday"); err == nil {
+		t.Error("expected error for invalid timestamp")
+	}
+	if _, err = ParsePosition("middle"); err == nil {
+		t.Error("expected error for unknown position")
+	}
+}
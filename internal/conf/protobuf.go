@@ -0,0 +1,25 @@
+package conf
+
+import (
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+)
+
+// Load parses the schema file and returns the descriptor of the configured root type.
+func (protobufSchemaConf *ProtobufSchema) Load() (*desc.MessageDescriptor, error) {
+	var protoParser protoparse.Parser
+	//TODO: set protoParser.Accessor instead of importpaths - a function that can produce io.Readers from ConsumerConfig.
+	protoParser.ImportPaths = append(protoParser.ImportPaths, protobufSchemaConf.Path)
+	fds, err := protoParser.ParseFiles(protobufSchemaConf.FileName)
+	if err != nil {
+		return nil, err
+	}
+	fd := fds[0]
+	messageDescriptor := fd.FindMessage(protobufSchemaConf.Type)
+	if messageDescriptor == nil {
+		return nil, fmt.Errorf("message type %s not found in %s", protobufSchemaConf.Type, protobufSchemaConf.FileName)
+	}
+	return messageDescriptor, nil
+}
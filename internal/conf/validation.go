@@ -0,0 +1,451 @@
+package conf
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ValidationError is a single problem in a KafkaConfig, located by its json path.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d config problem(s): %s", len(errs), strings.Join(msgs, "; "))
+}
+
+type ValidationOptions struct {
+	// CheckSchemaRegistry makes validation fail if a configured schema registry cannot be reached
+	CheckSchemaRegistry bool
+	// Warn receives problems that do not stop the config from being activated, because configs written before
+	// validation existed rely on the lenient handling. Warnings are dropped if it is nil
+	Warn func(ValidationError)
+}
+
+// Validate checks the whole config, and returns ValidationErrors with every problem found, or nil.
+func (config *KafkaConfig) Validate(options ValidationOptions) error {
+	v := &validator{options: options, registries: make(map[string]error)}
+
+	producers := make(map[string]int)
+	for i := range config.Producers {
+		v.producer(fmt.Sprintf("producers[%d]", i), &config.Producers[i])
+		v.unique(fmt.Sprintf("producers[%d].dataset", i), "producers", config.Producers[i].Dataset, i, producers)
+	}
+	consumers := make(map[string]int)
+	for i := range config.Consumers {
+		v.consumer(fmt.Sprintf("consumers[%d]", i), &config.Consumers[i])
+		v.unique(fmt.Sprintf("consumers[%d].dataset", i), "consumers", config.Consumers[i].Dataset, i, consumers)
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+type validator struct {
+	options    ValidationOptions
+	registries map[string]error
+	errs       ValidationErrors
+}
+
+func (v *validator) fail(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warn(path string, format string, args ...interface{}) {
+	if v.options.Warn != nil {
+		v.options.Warn(ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *validator) required(path string, value string) {
+	if value == "" {
+		v.fail(path, "is required")
+	}
+}
+
+func (v *validator) unique(path string, list string, dataset string, idx int, seen map[string]int) {
+	if dataset == "" {
+		return
+	}
+	if first, ok := seen[dataset]; ok {
+		v.fail(path, "duplicate dataset %q, also used by %s[%d]", dataset, list, first)
+		return
+	}
+	seen[dataset] = idx
+}
+
+func (v *validator) producer(path string, config *ProducerConfig) {
+	v.required(path+".dataset", config.Dataset)
+	v.required(path+".topic", config.Topic)
+
+	if config.CreateTopic {
+		if config.TopicSettings == nil {
+			v.fail(path+".topicSettings", "is required when createTopic is true")
+		} else {
+			if config.TopicSettings.Partitions < 1 {
+				v.fail(path+".topicSettings.partitions", "must be at least 1")
+			}
+			if config.TopicSettings.Replicas < 1 {
+				v.fail(path+".topicSettings.replicas", "must be at least 1")
+			}
+		}
+	}
+
+	if _, err := ParseKey(config.Key); err != nil {
+		v.warn(path+".key", "%v, messages are written without key", err)
+	}
+	switch config.KeyMissing {
+	case "", KeyMissingFail, KeyMissingId, KeyMissingNull:
+	default:
+		v.fail(path+".keyMissing", "unsupported policy %q, must be fail, id or null", config.KeyMissing)
+	}
+	if config.DeletedAsTombstone && config.Key != nil && *config.Key == KeyUUID {
+		v.fail(path+".deletedAsTombstone", "requires a key that identifies the entity, a uuid key never compacts")
+	}
+
+	names := make(map[string]int)
+	for i, h := range config.Headers {
+		hPath := fmt.Sprintf("%s.headers[%d]", path, i)
+		if h == nil {
+			v.fail(hPath, "must not be null")
+			continue
+		}
+		v.required(hPath+".name", h.Name)
+		if first, ok := names[h.Name]; ok && h.Name != "" {
+			v.fail(hPath+".name", "duplicate header %q, also set by headers[%d]", h.Name, first)
+		} else {
+			names[h.Name] = i
+		}
+		switch h.Source {
+		case HeaderSourceStatic:
+			v.required(hPath+".value", h.Value)
+		case HeaderSourceProperty:
+			if _, err := ParseEntityPath(h.Path); err != nil {
+				v.fail(hPath+".path", "%v", err)
+			}
+		case HeaderSourceId, HeaderSourceDataset, HeaderSourceCorrelationId, HeaderSourceTimestamp:
+		default:
+			v.fail(hPath+".source", "unsupported source %q, must be static, id, dataset, property, correlationId or timestamp", h.Source)
+		}
+	}
+
+	if config.TransactionalId != "" && !config.Transactional {
+		v.fail(path+".transactionalId", "is only used when transactional is true")
+	}
+	if config.TransactionTimeout != "" {
+		if !config.Transactional {
+			v.fail(path+".transactionTimeout", "is only used when transactional is true")
+		} else if d, err := time.ParseDuration(config.TransactionTimeout); err != nil || d < time.Second {
+			v.fail(path+".transactionTimeout", "invalid duration %q, expected at least 1s, like \"5m\"", config.TransactionTimeout)
+		}
+	}
+
+	if config.Mapping != nil {
+		v.mapping(path+".mapping", config.Mapping)
+	}
+
+	if config.FullSync != nil {
+		switch config.FullSync.Strategy {
+		case FullSyncMarkers:
+		case FullSyncVersionedTopic:
+			v.required(path+".fullSync.aliasTopic", config.FullSync.AliasTopic)
+		case FullSyncTombstones:
+			// messages without key are not tracked, so nothing would ever be deleted
+			key, err := ParseKey(config.Key)
+			switch {
+			case err != nil || key.Kind == KeyNone:
+				v.fail(path+".fullSync.strategy", "tombstones need a key that identifies the entity")
+			case key.Kind == KeyUUID:
+				v.fail(path+".fullSync.strategy", "tombstones need a key that identifies the entity, not uuid")
+			}
+		default:
+			v.fail(path+".fullSync.strategy", "unsupported strategy %q, must be markers, versionedTopic or tombstones", config.FullSync.Strategy)
+		}
+	}
+
+	if config.BatchSize < 0 {
+		v.fail(path+".batchSize", "must not be negative")
+	}
+	if config.MaxAttempts < 0 {
+		v.fail(path+".maxAttempts", "must not be negative")
+	}
+	if config.BatchTimeout != "" {
+		if d, err := time.ParseDuration(config.BatchTimeout); err != nil || d < 0 {
+			v.fail(path+".batchTimeout", "invalid duration %q, expected something like \"500ms\"", config.BatchTimeout)
+		}
+	}
+	switch config.RequiredAcks {
+	case "", "none", "one", "all":
+	default:
+		v.fail(path+".requiredAcks", "unsupported value %q, must be none, one or all", config.RequiredAcks)
+	}
+	switch config.Compression {
+	case "", "none", "gzip", "snappy", "lz4", "zstd":
+	default:
+		v.fail(path+".compression", "unsupported compression %q, must be none, gzip, snappy, lz4 or zstd", config.Compression)
+	}
+
+	if config.ValueEncoder != nil {
+		switch *config.ValueEncoder {
+		case "json":
+		case "avro":
+			v.schemaRegistry(path+".schemaRegistry", config.SchemaRegistry)
+		case "protobuf":
+			v.protobufSchema(path+".protobufSchema", config.ProtobufSchema)
+		default:
+			v.fail(path+".valueEncoder", "unsupported value encoder %q, must be json, avro or protobuf", *config.ValueEncoder)
+		}
+	}
+}
+
+func (v *validator) mapping(path string, mapping *OutboundMapping) {
+	switch mapping.Namespaces {
+	case "", NamespacesStrip, NamespacesExpand, NamespacesKeep:
+	default:
+		v.fail(path+".namespaces", "unsupported value %q, must be strip, expand or keep", mapping.Namespaces)
+	}
+	paths := make(map[string]int)
+	for i, f := range mapping.Fields {
+		fPath := fmt.Sprintf("%s.fields[%d]", path, i)
+		if f == nil {
+			v.fail(fPath, "must not be null")
+			continue
+		}
+		if f.Source != OutboundSourceDeleted {
+			if _, err := ParseEntityPath(f.Source); err != nil {
+				v.fail(fPath+".source", "%v", err)
+			}
+		}
+		if f.Ignore {
+			continue
+		}
+		v.required(fPath+".path", f.Path)
+		if f.Path == "" {
+			continue
+		}
+		if strings.HasPrefix(f.Path, ".") || strings.HasSuffix(f.Path, ".") || strings.Contains(f.Path, "..") {
+			v.fail(fPath+".path", "invalid path %q", f.Path)
+		}
+		if first, ok := paths[f.Path]; ok {
+			v.fail(fPath+".path", "duplicate path %q, also used by fields[%d]", f.Path, first)
+		} else {
+			paths[f.Path] = i
+		}
+	}
+}
+
+func (v *validator) consumer(path string, config *ConsumerConfig) {
+	v.required(path+".dataset", config.Dataset)
+	v.required(path+".topic", config.Topic)
+	if !config.Stateless && config.GroupId == "" {
+		v.warn(path+".groupId", "is missing, the dataset name is used as consumer group")
+	}
+
+	if _, err := ParsePosition(config.Position); err != nil {
+		v.fail(path+".position", "%v", err)
+	}
+
+	if config.ValueDecoder != nil {
+		switch *config.ValueDecoder {
+		case "json":
+		case "avro":
+			v.schemaRegistry(path+".schemaRegistry", config.SchemaRegistry)
+		case "protobuf":
+			v.protobufSchema(path+".protobufSchema", config.ProtobufSchema)
+		default:
+			v.fail(path+".valueDecoder", "unsupported value decoder %q, must be json, avro or protobuf", *config.ValueDecoder)
+		}
+	}
+
+	switch config.OnDecodeError {
+	case "", OnDecodeErrorFail, OnDecodeErrorSkip:
+	case OnDecodeErrorDeadLetter:
+		v.required(path+".deadLetterTopic", config.DeadLetterTopic)
+	default:
+		v.fail(path+".onDecodeError", "unsupported policy %q, must be fail, skip or deadLetter", config.OnDecodeError)
+	}
+
+	switch config.OnMappingError {
+	case "", OnMappingErrorFail, OnMappingErrorSkip, OnMappingErrorDropField:
+	case OnMappingErrorDeadLetter:
+		if config.OnDecodeError != OnDecodeErrorDeadLetter {
+			v.required(path+".deadLetterTopic", config.DeadLetterTopic)
+		}
+	default:
+		v.fail(path+".onMappingError", "unsupported policy %q, must be fail, skip, deadLetter or dropField", config.OnMappingError)
+	}
+
+	switch config.IsolationLevel {
+	case "", "read_committed", "read_uncommitted":
+	default:
+		v.fail(path+".isolationLevel", "unsupported isolation level %q, must be read_committed or read_uncommitted", config.IsolationLevel)
+	}
+
+	if config.TypePath != "" && len(config.Types) == 0 {
+		v.fail(path+".typePath", "requires types")
+	}
+
+	idField := -1
+	for i, m := range config.FieldMappings {
+		mPath := fmt.Sprintf("%s.fieldMappings[%d]", path, i)
+		if m == nil {
+			v.fail(mPath, "must not be null")
+			continue
+		}
+		v.required(mPath+".fieldName", m.FieldName)
+		if m.IsIdField {
+			if idField >= 0 {
+				v.fail(mPath+".isIdField", "only one id field is allowed, already set on fieldMappings[%d]", idField)
+			} else {
+				idField = i
+			}
+		}
+		if m.IsReference && m.ReferenceTemplate == "" {
+			v.fail(mPath+".referenceTemplate", "is required when isReference is true")
+		}
+		if m.AsEntities && (m.IsIdField || m.IsDeletedField || m.IsReference) {
+			v.fail(mPath+".asEntities", "cannot be combined with isIdField, isDeletedField or isReference")
+		}
+		if m.ElementIdPath != "" {
+			if !m.AsEntities {
+				v.fail(mPath+".elementIdPath", "requires asEntities")
+			}
+			v.required(mPath+".referenceTemplate", m.ReferenceTemplate)
+		}
+		v.conversion(mPath, m)
+	}
+	if idField >= 0 && !strings.Contains(config.EntityIdConstructor, "%") {
+		v.fail(path+".entityIdConstructor", "must be a format string like \"person/%%s\" when an id field is mapped")
+	}
+
+	if config.IdTemplate != "" {
+		if _, err := ParseIdTemplate(config.IdTemplate); err != nil {
+			v.fail(path+".idTemplate", "%v", err)
+		}
+		if idField >= 0 {
+			v.fail(path+".idTemplate", "cannot be combined with isIdField on fieldMappings[%d]", idField)
+		}
+	}
+	switch config.Nesting {
+	case "", NestingFlatten:
+		if len(config.NestedNameSpaces) > 0 {
+			v.fail(path+".nestedNameSpaces", "requires nesting to be entities")
+		}
+	case NestingEntities:
+		for field, ns := range config.NestedNameSpaces {
+			if field == "" || ns == "" {
+				v.fail(path+".nestedNameSpaces", "field paths and namespaces must not be empty")
+				break
+			}
+		}
+	default:
+		v.fail(path+".nesting", "unsupported nesting %q, must be flatten or entities", config.Nesting)
+	}
+
+	switch config.IdMissing {
+	case "", IdMissingKafkaKey, IdMissingPartitionOffset, IdMissingSkip:
+	default:
+		v.fail(path+".idMissing", "unsupported policy %q, must be kafkaKey, partitionOffset or skip", config.IdMissing)
+	}
+}
+
+func (v *validator) conversion(path string, m *FieldMapping) {
+	switch m.Datatype {
+	case "", DatatypeString, DatatypeInt, DatatypeFloat, DatatypeBool, DatatypeUUID:
+		if m.DatetimeFormat != "" {
+			v.fail(path+".datetimeFormat", "requires datatype datetime")
+		}
+	case DatatypeDatetime:
+	default:
+		v.fail(path+".datatype", "unsupported datatype %q, must be string, int, float, bool, datetime or uuid", m.Datatype)
+	}
+	for i, t := range m.Transforms {
+		tPath := fmt.Sprintf("%s.transforms[%d]", path, i)
+		if t == nil {
+			v.fail(tPath, "must not be null")
+			continue
+		}
+		switch t.Type {
+		case TransformLowercase, TransformUppercase, TransformTrim:
+		case TransformReplace:
+			if _, err := regexp.Compile(t.Pattern); err != nil || t.Pattern == "" {
+				v.fail(tPath+".pattern", "must be a regular expression")
+			}
+		case TransformDefault:
+			if t.Value == nil {
+				v.fail(tPath+".value", "is required")
+			}
+		case TransformMap:
+			if len(t.Values) == 0 {
+				v.fail(tPath+".values", "is required")
+			}
+		default:
+			v.fail(tPath+".type", "unsupported transform %q, must be lowercase, uppercase, trim, replace, default or map", t.Type)
+		}
+	}
+}
+
+func (v *validator) schemaRegistry(path string, registry *SchemaRegistry) {
+	if registry == nil || registry.Location == "" {
+		v.fail(path+".location", "is required")
+		return
+	}
+	if !v.options.CheckSchemaRegistry {
+		return
+	}
+	err, checked := v.registries[registry.Location]
+	if !checked {
+		err = pingSchemaRegistry(registry.Location)
+		v.registries[registry.Location] = err
+	}
+	if err != nil {
+		v.fail(path+".location", "schema registry is not reachable: %v", err)
+	}
+}
+
+func (v *validator) protobufSchema(path string, schema *ProtobufSchema) {
+	if schema == nil {
+		v.fail(path, "is required")
+		return
+	}
+	v.required(path+".path", schema.Path)
+	v.required(path+".fileName", schema.FileName)
+	v.required(path+".type", schema.Type)
+	if schema.Path == "" || schema.FileName == "" || schema.Type == "" {
+		return
+	}
+	if _, err := schema.Load(); err != nil {
+		v.fail(path, "could not load schema: %v", err)
+	}
+}
+
+func pingSchemaRegistry(location string) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(location, "/") + "/subjects")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry returned %s", resp.Status)
+	}
+	return nil
+}
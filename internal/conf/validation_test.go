@@ -0,0 +1,151 @@
+package conf
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestValidate(t *testing.T) {
+	cmgr := ConfigurationManager{
+		logger: zap.NewNop().Sugar(),
+	}
+	resourcesTestPath := "../../resources/test"
+	overridePath := os.Getenv("RESOURCES_TEST_DIR")
+	if overridePath != "" {
+		resourcesTestPath = overridePath
+	}
+	res, err := cmgr.loadFile("file://" + path.Join(resourcesTestPath, "/test-config.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	res = bytes.ReplaceAll(res, []byte("RESOURCEPATH"), []byte(resourcesTestPath))
+
+	config, err := cmgr.parse(res)
+	if err != nil {
+		t.FailNow()
+	}
+	if err = config.Validate(ValidationOptions{}); err != nil {
+		t.Errorf("test config should be valid: %v", err)
+	}
+
+	avro := "avro"
+	proto := "protobuf"
+	broken := &KafkaConfig{
+		Producers: []ProducerConfig{
+			{Dataset: "p1", Topic: "t1", CreateTopic: true, Headers: []*HeaderMapping{
+				{Name: "origin", Source: "env"},
+				{Name: "customer", Source: HeaderSourceProperty, Path: "customerId"},
+			}},
+			{Dataset: "p1", Topic: "t2", BatchTimeout: "soon", Compression: "zip", TransactionalId: "tx", TransactionTimeout: "1m",
+				FullSync: &FullSyncSettings{Strategy: FullSyncVersionedTopic},
+				Mapping: &OutboundMapping{Namespaces: "drop", Fields: []*OutboundField{
+					{Source: "props:ns0:name", Path: "customer.name"},
+					{Source: "refs:ns0:country", Path: "customer.name"},
+				}}},
+			{Dataset: "p3", Topic: "t3", FullSync: &FullSyncSettings{Strategy: FullSyncTombstones}},
+		},
+		Consumers: []ConsumerConfig{
+			{
+				Dataset:      "c1",
+				Topic:        "t1",
+				GroupId:      "g1",
+				ValueDecoder: &avro,
+				Position:     "yesterday",
+				Nesting:      "deep",
+				FieldMappings: []*FieldMapping{
+					{FieldName: "a", IsIdField: true},
+					{FieldName: "b", IsIdField: true},
+					{FieldName: "c", AsEntities: true, IsReference: true, ReferenceTemplate: "http://c/%v"},
+					{FieldName: "d", ElementIdPath: "id"},
+					{FieldName: "e", Datatype: "date", Transforms: []*Transform{{Type: TransformReplace, Pattern: "("}}},
+				},
+			},
+			{
+				Dataset:      "c2",
+				Topic:        "t2",
+				GroupId:      "g2",
+				ValueDecoder: &proto,
+				ProtobufSchema: &ProtobufSchema{
+					Path:     path.Join(resourcesTestPath, "/protoschema"),
+					FileName: "person.proto",
+					Type:     "testdata.Pet",
+				},
+				OnDecodeError:  "deadLetter",
+				IdTemplate:     "{tenant",
+				IdMissing:      "random",
+				OnMappingError: "retry",
+			},
+		},
+	}
+	err = broken.Validate(ValidationOptions{})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	expected := []string{
+		"producers[0].topicSettings",
+		"producers[0].headers[0].source",
+		"producers[0].headers[1].path",
+		"producers[1].dataset",
+		"producers[1].transactionalId",
+		"producers[1].transactionTimeout",
+		"producers[1].fullSync.aliasTopic",
+		"producers[1].batchTimeout",
+		"producers[1].compression",
+		"producers[1].mapping.namespaces",
+		"producers[1].mapping.fields[1].path",
+		"producers[2].fullSync.strategy",
+		"consumers[0].position",
+		"consumers[0].nesting",
+		"consumers[0].schemaRegistry.location",
+		"consumers[0].fieldMappings[1].isIdField",
+		"consumers[0].fieldMappings[2].asEntities",
+		"consumers[0].fieldMappings[3].elementIdPath",
+		"consumers[0].fieldMappings[3].referenceTemplate",
+		"consumers[0].fieldMappings[4].datatype",
+		"consumers[0].fieldMappings[4].transforms[0].pattern",
+		"consumers[0].entityIdConstructor",
+		"consumers[1].protobufSchema",
+		"consumers[1].deadLetterTopic",
+		"consumers[1].idTemplate",
+		"consumers[1].idMissing",
+		"consumers[1].onMappingError",
+	}
+	paths := make(map[string]bool)
+	for _, e := range errs {
+		paths[e.Path] = true
+	}
+	for _, p := range expected {
+		if !paths[p] {
+			t.Errorf("expected problem at %s, got %v", p, err)
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("expected %d problems, got %v", len(expected), err)
+	}
+	if !strings.Contains(err.Error(), "testdata.Pet") {
+		t.Errorf("expected missing proto type in error, got %v", err)
+	}
+
+	// configs written before validation existed keep working, with warnings
+	key := "customer"
+	lenient := &KafkaConfig{
+		Producers: []ProducerConfig{{Dataset: "p1", Topic: "t1", Key: &key}},
+		Consumers: []ConsumerConfig{{Dataset: "c1", Topic: "t1"}},
+	}
+	var warnings []string
+	err = lenient.Validate(ValidationOptions{Warn: func(e ValidationError) {
+		warnings = append(warnings, e.Path)
+	}})
+	if err != nil {
+		t.Errorf("expected a missing groupId and an unsupported key to be accepted, got %v", err)
+	}
+	if len(warnings) != 2 || warnings[0] != "producers[0].key" || warnings[1] != "consumers[0].groupId" {
+		t.Errorf("expected warnings for the key and the groupId, got %v", warnings)
+	}
+}
@@ -2,19 +2,18 @@ package kafka
 
 import (
 	"context"
+	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"os/signal"
-	"strings"
+	"strconv"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/hashicorp/go-uuid"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 
@@ -29,21 +28,48 @@ type Consumers struct {
 	bootstrapServers []string
 	mngr             *conf.ConfigurationManager
 	statsd           statsd.ClientInterface
+	datasets         map[string]*dataset
+	invalid          map[string]error
 	running          map[string]*runState
+	dlqProducer      *kafka.Producer
+	shutdown         context.Context
+	stopAll          context.CancelFunc
+	closing          bool
+	reads            sync.WaitGroup
 	lock             *sync.RWMutex
+	updateLock       sync.Mutex
 }
 
+var (
+	ErrDatasetNotFound = errors.New("dataset not found")
+	ErrDatasetInvalid  = errors.New("dataset config is invalid")
+	ErrTopicNotFound   = errors.New("topic not found")
+)
+
 type DatasetRequest struct {
+	// Context ends the read when it is done, typically because the client has disconnected
+	Context     context.Context
 	DatasetName string
 	Since       string
 	Limit       int64
 }
 
+// dataset is an active consumer config, with its decoder and encoder built up front.
+type dataset struct {
+	config  *conf.ConsumerConfig
+	digest  string
+	decoder coder.Decoder
+	encoder coder.EntityEncoder
+}
+
 type runState struct {
 	consumer    *kafka.Consumer
 	ctx         context.Context
 	cancel      context.CancelFunc
 	decoder     coder.Decoder
+	dataset     string
+	digest      string
+	topicGroup  string // empty for stateless reads, which are never cancelled by other reads
 	isCancelled bool
 }
 
@@ -54,10 +80,13 @@ func NewConsumers(lc fx.Lifecycle, env *conf.Env, mngr *conf.ConfigurationManage
 		bootstrapServers: env.KafkaBrokers,
 		mngr:             mngr,
 		statsd:           statsd,
+		datasets:         make(map[string]*dataset),
+		invalid:          make(map[string]error),
 		running:          make(map[string]*runState),
 		lock:             &sync.RWMutex{},
 	}
-	a, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": strings.Join(config.bootstrapServers, ",")})
+	config.shutdown, config.stopAll = context.WithCancel(context.Background())
+	a, err := kafka.NewAdminClient(clientConfig(env, nil))
 	if err != nil {
 		return nil, err
 	}
@@ -66,101 +95,271 @@ func NewConsumers(lc fx.Lifecycle, env *conf.Env, mngr *conf.ConfigurationManage
 		OnStart: func(ctx context.Context) error {
 			config.logger.Info("Registering Kafka consumers")
 			config.logger.Info(env.KafkaBrokers)
-			for _, c := range mngr.Datalayer.Consumers {
-				config.add(c)
+			mngr.AddConfigUpdateListener(func(digest [16]byte) {
+				config.update(mngr.Datalayer.Consumers)
+			})
+			if mngr.Datalayer != nil {
+				config.update(mngr.Datalayer.Consumers)
 			}
 			return nil
 		},
-		OnStop: nil,
+		OnStop: func(ctx context.Context) error {
+			// new reads are rejected, and running reads end with a continuation token for what was already sent
+			config.lock.Lock()
+			config.closing = true
+			config.lock.Unlock()
+			config.stopAll()
+
+			config.logger.Info("Waiting for running reads to finish")
+			err := wait(ctx, &config.reads)
+			if err != nil {
+				config.logger.Warnf("Gave up waiting for running reads: %v", err)
+			}
+
+			config.lock.Lock()
+			defer config.lock.Unlock()
+			if config.dlqProducer != nil {
+				config.logger.Info("Stopping dead letter producer")
+				config.dlqProducer.Flush(5000)
+				config.dlqProducer.Close()
+			}
+			config.logger.Info("Stopping admin client")
+			config.adminClient.Close()
+			return err
+		},
 	})
 
 	return config, nil
 }
 
-func (consumers *Consumers) add(config conf.ConsumerConfig) {
-	consumers.logger.Info("Got " + config.Topic)
+// update replaces the active consumer datasets with the given configs. Decoders and encoders are built up front,
+// and a dataset with an invalid config keeps running with its last good config. Reads of removed or changed
+// datasets are cancelled, so they end with a continuation token for what was already sent.
+func (consumers *Consumers) update(configs []conf.ConsumerConfig) {
+	consumers.updateLock.Lock()
+	defer consumers.updateLock.Unlock()
+
+	datasets := make(map[string]*dataset)
+	invalid := make(map[string]error)
+	consumers.lock.RLock()
+	for _, c := range configs {
+		c := c
+		digest := configDigest(&c)
+		if existing, ok := consumers.datasets[c.Dataset]; ok && existing.digest == digest {
+			datasets[c.Dataset] = existing
+			continue
+		}
+		ds, err := newDataset(&c, digest)
+		if err != nil {
+			consumers.logger.Warnf("Invalid config for dataset %s: %v", c.Dataset, err)
+			if existing, ok := consumers.datasets[c.Dataset]; ok {
+				consumers.logger.Warnf("Dataset %s keeps running with config %s", c.Dataset, existing.digest)
+				datasets[c.Dataset] = existing
+			} else {
+				invalid[c.Dataset] = err
+			}
+			continue
+		}
+		consumers.logger.Infof("Registered dataset %s on topic %s with config %s", c.Dataset, c.Topic, digest)
+		datasets[c.Dataset] = ds
+	}
+	consumers.lock.RUnlock()
+
+	consumers.lock.Lock()
+	defer consumers.lock.Unlock()
+	for name := range consumers.datasets {
+		if _, ok := datasets[name]; !ok {
+			consumers.logger.Infof("Removed dataset %s", name)
+		}
+	}
+	consumers.datasets = datasets
+	consumers.invalid = invalid
+	for _, state := range consumers.running {
+		if ds, ok := datasets[state.dataset]; !ok || ds.digest != state.digest {
+			consumers.logger.Infof("Cancelling read of dataset %s, config %s is no longer active", state.dataset, state.digest)
+			state.cancel()
+		}
+	}
+}
+
+func newDataset(config *conf.ConsumerConfig, digest string) (*dataset, error) {
+	if _, err := conf.ParsePosition(config.Position); err != nil {
+		return nil, err
+	}
+	decoder, err := coder.NewDecoder(config)
+	if err != nil {
+		return nil, err
+	}
+	return &dataset{
+		config:  config,
+		digest:  digest,
+		decoder: decoder,
+		encoder: coder.NewEntityEncoder(config),
+	}, nil
+}
+
+func configDigest(config *conf.ConsumerConfig) string {
+	themBytes, _ := json.Marshal(config)
+	return fmt.Sprintf("%x", md5.Sum(themBytes))
+}
+
+func (consumers *Consumers) dataset(datasetName string) *dataset {
+	consumers.lock.RLock()
+	defer consumers.lock.RUnlock()
+	return consumers.datasets[datasetName]
 }
 
 func (consumers *Consumers) DoesDatasetExist(datasetName string) bool {
-	for _, c := range consumers.mngr.Datalayer.Consumers {
-		if c.Dataset == datasetName {
-			return true
-		}
+	return consumers.dataset(datasetName) != nil
+}
+
+// ConfigDigest returns the digest of the config the dataset is currently running with.
+func (consumers *Consumers) ConfigDigest(datasetName string) string {
+	if ds := consumers.dataset(datasetName); ds != nil {
+		return ds.digest
 	}
-	return false
+	return ""
+}
+
+// Preflight checks that a read of the dataset can start, so problems can be reported before any output is
+// written. The returned error is ErrShuttingDown, wraps ErrDatasetNotFound, ErrDatasetInvalid or ErrTopicNotFound,
+// or is a metadata lookup error.
+func (consumers *Consumers) Preflight(datasetName string) error {
+	consumers.lock.RLock()
+	if consumers.closing {
+		consumers.lock.RUnlock()
+		return ErrShuttingDown
+	}
+	ds := consumers.datasets[datasetName]
+	invalidErr := consumers.invalid[datasetName]
+	consumers.lock.RUnlock()
+	if invalidErr != nil {
+		return fmt.Errorf("%w: %s: %v", ErrDatasetInvalid, datasetName, invalidErr)
+	}
+	if ds == nil {
+		return fmt.Errorf("%w: %s", ErrDatasetNotFound, datasetName)
+	}
+
+	topic := ds.config.Topic
+	m, err := consumers.adminClient.GetMetadata(&topic, false, 5000)
+	if err != nil {
+		return fmt.Errorf("could not read metadata for topic %s: %w", topic, err)
+	}
+	t, ok := m.Topics[topic]
+	if !ok || t.Error.Code() == kafka.ErrUnknownTopicOrPart || len(t.Partitions) == 0 {
+		return fmt.Errorf("%w: %s", ErrTopicNotFound, topic)
+	}
+	return nil
 }
 
 func (consumers *Consumers) config(datasetName string) *conf.ConsumerConfig {
-	for _, c := range consumers.mngr.Datalayer.Consumers {
-		if c.Dataset == datasetName {
-			return &c
-		}
+	if ds := consumers.dataset(datasetName); ds != nil {
+		return ds.config
 	}
 	return nil
 }
 
 func (consumers *Consumers) GetContext(datasetName string) map[string]interface{} {
 	config := consumers.config(datasetName)
-
-	ctx := make(map[string]interface{})
-	namespaces := make(map[string]string)
-
-	namespaces["ns0"] = config.BaseNameSpace + config.NameSpace + "/"
-	namespaces["rdf"] = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
-	ctx["namespaces"] = namespaces
-	ctx["id"] = "@context"
-	return ctx
+	if config == nil {
+		return map[string]interface{}{"id": "@context"}
+	}
+	return coder.DatasetContext(config)
 }
 
 func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*coder.Entity)) error {
-	config := consumers.config(request.DatasetName)
-	if config == nil {
+	consumers.lock.Lock()
+	if consumers.closing {
+		consumers.lock.Unlock()
+		return ErrShuttingDown
+	}
+	consumers.reads.Add(1)
+	consumers.lock.Unlock()
+	defer consumers.reads.Done()
+
+	ds := consumers.dataset(request.DatasetName)
+	if ds == nil {
 		return errors.New("config has disappeared, bad mojo")
 	}
+	config := ds.config
 
 	tags := []string{
 		fmt.Sprintf("application:%s", consumers.env.ServiceName),
 		fmt.Sprintf("topic:%s", config.Topic),
 	}
 
-	// if multiple requests are made for the same groupId and topic, we need to make sure only one is running
-	// at a time
-	topicGroup := fmt.Sprintf("%s-%s", config.Topic, config.GroupId)
-	consumers.lock.RLock()
-	if cons, ok := consumers.running[topicGroup]; ok {
-		// so, this means something is still running, so cancel it, and reset
-		cons.cancel()
-		if !cons.isCancelled {
-			_ = cons.consumer.Close() // this should hopefully allow us to clean exit the previous consumer if still running
+	groupId := config.GroupId
+	if groupId == "" {
+		// librdkafka requires a group.id, even when partitions are assigned manually
+		groupId = config.Dataset
+	}
+
+	// in group mode, if multiple requests are made for the same groupId and topic, we need to make sure only one
+	// is running at a time. stateless reads never touch the group, so they can run side by side, and are left out
+	topicGroup := ""
+	if !config.Stateless {
+		topicGroup = fmt.Sprintf("%s-%s", config.Topic, groupId)
+		consumers.lock.RLock()
+		for _, cons := range consumers.running {
+			if cons.topicGroup != topicGroup {
+				continue
+			}
+			// so, this means something is still running, so cancel it, and reset
+			cons.cancel()
+			if !cons.isCancelled {
+				_ = cons.consumer.Close() // this should hopefully allow us to clean exit the previous consumer if still running
+			}
 		}
+		consumers.lock.RUnlock()
 	}
-	consumers.lock.RUnlock()
 
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":  strings.Join(consumers.bootstrapServers, ","),
-		"group.id":           config.GroupId,
-		"enable.auto.commit": false,
-		"session.timeout.ms": 6000,
-		"auto.offset.reset":  "earliest"})
+	position, err := conf.ParsePosition(config.Position)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	autoOffsetReset := conf.PositionEarliest
+	if position.Kind == conf.PositionLatest {
+		autoOffsetReset = conf.PositionLatest
+	}
 
-	decoder, err := coder.NewDecoder(config)
+	settings := kafka.ConfigMap{
+		"group.id":                 groupId,
+		"enable.auto.commit":       false,
+		"enable.auto.offset.store": false,
+		"session.timeout.ms":       6000,
+		"auto.offset.reset":        autoOffsetReset}
+	if config.IsolationLevel != "" {
+		settings["isolation.level"] = config.IsolationLevel
+	}
+	consumer, err := kafka.NewConsumer(clientConfig(consumers.env, settings))
 	if err != nil {
-		cancel()
 		return err
 	}
+	parent := request.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	stopOnShutdown := context.AfterFunc(consumers.shutdown, cancel)
+	defer stopOnShutdown()
+
+	runId, _ := uuid.GenerateUUID()
 	state := &runState{
 		consumer:    consumer,
 		ctx:         ctx,
 		cancel:      cancel,
-		decoder:     decoder,
+		decoder:     ds.decoder,
+		dataset:     config.Dataset,
+		digest:      ds.digest,
+		topicGroup:  topicGroup,
 		isCancelled: false,
 	}
 	consumers.lock.Lock()
-	consumers.running[topicGroup] = state
+	consumers.running[runId] = state
+	if current, ok := consumers.datasets[config.Dataset]; !ok || current.digest != ds.digest {
+		// the config changed while this read was starting up
+		state.cancel()
+	}
 	consumers.lock.Unlock()
 
 	// clean up, but there is a chance that this is never run
@@ -172,26 +371,37 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 		state.isCancelled = true
 
 		consumers.lock.Lock()
-		delete(consumers.running, topicGroup)
+		delete(consumers.running, runId)
 		consumers.lock.Unlock()
 	}()
 
-	// so, if we get an offset, we need to reset the offsets now
+	// so, if we get an offset, we start from there, otherwise from the configured position
 	offsets := decodeSince(request.Since)
 	consumers.logger.Debugf("supplied offsets via since token: %+v", offsets)
-	err = consumers.resetOffsets(offsets, config, state.consumer)
+	partitions, started, err := consumers.startOffsets(offsets, position, config, state.consumer)
 	if err != nil {
 		return err
 	}
 
-	err = state.consumer.Subscribe(config.Topic, nil)
-	if err != nil {
-		return err
+	if config.Stateless {
+		// no group membership and no commits, the since token is the only state
+		err = state.consumer.Assign(partitions)
+		if err != nil {
+			return err
+		}
+	} else {
+		if len(partitions) > 0 {
+			_, err = state.consumer.CommitOffsets(partitions)
+			if err != nil {
+				return err
+			}
+		}
+		err = state.consumer.Subscribe(config.Topic, nil)
+		if err != nil {
+			return err
+		}
 	}
 
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-
 	run := true
 	count := int64(0)
 
@@ -199,6 +409,7 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 
 	nilCount := 0
 	sinceCount := 0
+	var decodeErr error
 
 	defer func() {
 		if run {
@@ -207,16 +418,20 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 		}
 	}()
 
-	encoder := coder.NewEntityEncoder(config)
+	encoder := ds.encoder
 	isBeginning := true
 
 	for run == true {
 		select {
 		case <-ctx.Done():
-			consumers.logger.Debug("Terminating poll loop")
-			run = false
-		case sig := <-sigchan:
-			consumers.logger.Infof("Caught signal %v: terminating", sig)
+			switch {
+			case parent.Err() != nil:
+				consumers.logger.Infof("Client went away, terminating poll loop for %s", config.Dataset)
+			case consumers.shutdown.Err() != nil:
+				consumers.logger.Infof("Shutting down, terminating poll loop for %s", config.Dataset)
+			default:
+				consumers.logger.Debug("Terminating poll loop")
+			}
 			run = false
 		default:
 			ev := state.consumer.Poll(500)
@@ -226,22 +441,40 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 				count++
 				nilCount = 0
 				isBeginning = false
-				sinceCount++
-				partitionOffsets[e.TopicPartition.Partition] = int64(e.TopicPartition.Offset)
-				value, err := state.decoder.Decode(e)
+				var value []byte
+				var err error
+				marker := isFullSyncMarker(e)
+				if e.Value != nil && !marker {
+					// tombstones have no value to decode, and are encoded as deleted entities
+					value, err = state.decoder.Decode(e)
+				}
 				if err != nil {
-					consumers.logger.Warn(err)
+					decodeErr = consumers.handleDecodeError(ctx, config, e, err)
+				}
+				var entity *coder.Entity
+				if err == nil && !marker {
+					entity, err = encoder.EncodeMessage(e, value)
+					if err != nil {
+						decodeErr = consumers.handleMappingError(ctx, config, e, err)
+					}
+				}
+				if decodeErr != nil {
+					// the failed message is not part of the continuation token, so it is retried next time
+					consumers.logger.Warn(decodeErr)
+					run = false
 					state.cancel()
+					break
 				}
+				sinceCount++
+				partitionOffsets[e.TopicPartition.Partition] = int64(e.TopicPartition.Offset)
 
-				var entity *coder.Entity
-				var includeHeaders = &config.IncludeHeaders
-				if *includeHeaders {
-					entity = encoder.EncodeWithHeaders(e.Key, value, e.Headers)
-				} else {
-					entity = encoder.Encode(e.Key, value)
+				// messages without id are skipped if the dataset is configured to do so
+				if entity != nil {
+					callBack(entity)
+				} else if err == nil && !marker {
+					consumers.logger.Debugf("skipping message without id at %s", e.TopicPartition)
+					_ = consumers.statsd.Incr("kafka.skipped", tags, 1)
 				}
-				callBack(entity)
 				if request.Limit > -1 && count >= request.Limit {
 					consumers.logger.Debugf("reached requested limit of %v. stop poll loop", count)
 					run = false
@@ -267,7 +500,10 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 							state.cancel()
 						}
 						consumers.logger.Debug("Waiting for data")
-						time.Sleep(1000 * time.Millisecond)
+						select {
+						case <-ctx.Done():
+						case <-time.After(1000 * time.Millisecond):
+						}
 					} else {
 						consumers.logger.Info("subscription depleted. cancelling consumer context")
 						state.cancel()
@@ -279,12 +515,12 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 
 	}
 
-	if sinceCount > 0 {
-		for p, offset := range offsets {
-			if _, ok := partitionOffsets[p]; !ok {
-				partitionOffsets[p] = offset
-			}
-		}
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	if sinceCount > 0 || len(started) > 0 {
+		partitionOffsets = continuationOffsets(partitionOffsets, offsets, started)
 		s, _ := since(partitionOffsets)
 		consumers.logger.Infof("Emitted %v msgs. offsets returned as @continuation: %+v (%+v)", sinceCount, partitionOffsets, s)
 		entity := coder.NewEntity()
@@ -306,45 +542,230 @@ func (consumers *Consumers) ChangeSet(request DatasetRequest, callBack func(*cod
 	return nil
 }
 
-func (consumers *Consumers) resetOffsets(offsets map[int32]int64, config *conf.ConsumerConfig, c *kafka.Consumer) error {
-	partitions := make([]kafka.TopicPartition, 0)
-	for k, v := range offsets {
-		consumers.logger.Infof("Resetting tp %d on %s to %d", k, config.Topic, v+1)
+// handleDecodeError applies the configured onDecodeError policy to a message that could not be decoded. It
+// returns an error if the read must stop.
+func (consumers *Consumers) handleDecodeError(ctx context.Context, config *conf.ConsumerConfig, msg *kafka.Message, decodeErr error) error {
+	switch config.OnDecodeError {
+	case conf.OnDecodeErrorSkip:
+		consumers.logger.Warnf("skipping undecodable message at %s: %v", msg.TopicPartition, decodeErr)
+		return nil
+	case conf.OnDecodeErrorDeadLetter:
+		err := consumers.deadLetter(ctx, config, msg, decodeErr)
+		if err != nil {
+			return fmt.Errorf("could not dead-letter undecodable message at %s: %w", msg.TopicPartition, err)
+		}
+		consumers.logger.Warnf("dead-lettered undecodable message at %s to %s: %v", msg.TopicPartition, config.DeadLetterTopic, decodeErr)
+		return nil
+	default:
+		return fmt.Errorf("could not decode message at %s: %w", msg.TopicPartition, decodeErr)
+	}
+}
+
+func (consumers *Consumers) handleMappingError(ctx context.Context, config *conf.ConsumerConfig, msg *kafka.Message, mappingErr error) error {
+	switch config.OnMappingError {
+	case conf.OnMappingErrorSkip:
+		consumers.logger.Warnf("skipping unmappable message at %s: %v", msg.TopicPartition, mappingErr)
+		return nil
+	case conf.OnMappingErrorDeadLetter:
+		err := consumers.deadLetter(ctx, config, msg, mappingErr)
+		if err != nil {
+			return fmt.Errorf("could not dead-letter unmappable message at %s: %w", msg.TopicPartition, err)
+		}
+		consumers.logger.Warnf("dead-lettered unmappable message at %s to %s: %v", msg.TopicPartition, config.DeadLetterTopic, mappingErr)
+		return nil
+	default:
+		return fmt.Errorf("could not map message at %s: %w", msg.TopicPartition, mappingErr)
+	}
+}
+
+// deadLetterTimeout bounds the delivery of a dead letter message, the read fails if it is not delivered in time.
+const deadLetterTimeout = 30 * time.Second
+
+// deadLetter writes the raw message to the configured dead letter topic, with its origin and the decode error
+// added as headers. It waits for the delivery report, or until the read ends.
+func (consumers *Consumers) deadLetter(ctx context.Context, config *conf.ConsumerConfig, msg *kafka.Message, decodeErr error) error {
+	producer, err := consumers.deadLetterProducer()
+	if err != nil {
+		return err
+	}
+
+	delivery := make(chan kafka.Event, 1)
+	err = producer.Produce(deadLetterMessage(config, msg, decodeErr), delivery)
+	if err != nil {
+		return err
+	}
+	var report kafka.Event
+	select {
+	case report = <-delivery:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	switch report := report.(type) {
+	case *kafka.Message:
+		return report.TopicPartition.Error
+	case kafka.Error:
+		return report
+	default:
+		return fmt.Errorf("unexpected delivery report for dead letter message: %v", report)
+	}
+}
+
+// deadLetterMessage copies the key, value and headers of the message, and adds dlq.* headers with its origin
+// and the error.
+func deadLetterMessage(config *conf.ConsumerConfig, msg *kafka.Message, decodeErr error) *kafka.Message {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	headers := make([]kafka.Header, 0, len(msg.Headers)+5)
+	headers = append(headers, msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: "dlq.dataset", Value: []byte(config.Dataset)},
+		kafka.Header{Key: "dlq.topic", Value: []byte(topic)},
+		kafka.Header{Key: "dlq.partition", Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+		kafka.Header{Key: "dlq.offset", Value: []byte(msg.TopicPartition.Offset.String())},
+		kafka.Header{Key: "dlq.error", Value: []byte(decodeErr.Error())},
+	)
+	return &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &config.DeadLetterTopic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        headers,
+	}
+}
+
+func (consumers *Consumers) deadLetterProducer() (*kafka.Producer, error) {
+	consumers.lock.Lock()
+	defer consumers.lock.Unlock()
+	if consumers.dlqProducer == nil {
+		p, err := kafka.NewProducer(clientConfig(consumers.env, kafka.ConfigMap{
+			"message.timeout.ms": int(deadLetterTimeout.Milliseconds()),
+		}))
+		if err != nil {
+			return nil, err
+		}
+		consumers.dlqProducer = p
+	}
+	return consumers.dlqProducer, nil
+}
+
+// startOffsets resolves the offsets to start reading from for every partition of the topic. With a since token,
+// partitions in the token continue after their offset, and partitions missing from it start at the beginning.
+// Without one, the configured position decides. The returned map holds the resolved start of every partition
+// positioned at latest or a timestamp, in since token form.
+func (consumers *Consumers) startOffsets(offsets map[int32]int64, position *conf.Position, config *conf.ConsumerConfig, c *kafka.Consumer) ([]kafka.TopicPartition, map[int32]int64, error) {
+	m, err := c.GetMetadata(&config.Topic, false, 1000)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]int32, 0)
+	if t, ok := m.Topics[config.Topic]; ok {
+		for _, p := range t.Partitions {
+			ids = append(ids, p.ID)
+		}
+	}
+
+	started := make(map[int32]int64)
+	if len(offsets) == 0 {
+		// we have no since token, reset to the configured position
+		partitions, err := consumers.positionOffsets(position, config.Topic, ids, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range partitions {
+			consumers.logger.Infof("Resetting tp %d on %s to %d (%s)", p.Partition, config.Topic, p.Offset, position.Kind)
+			if position.Kind != conf.PositionEarliest {
+				started[p.Partition] = int64(p.Offset) - 1
+			}
+		}
+		return partitions, started, nil
+	}
+
+	partitions := sinceOffsets(config.Topic, ids, offsets)
+	for _, p := range partitions {
+		consumers.logger.Infof("Resetting tp %d on %s to %d", p.Partition, config.Topic, p.Offset)
+	}
+	return partitions, started, nil
+}
+
+// sinceOffsets continues each partition after its offset in the since token, partitions missing from the token
+// start at the beginning.
+func sinceOffsets(topic string, ids []int32, offsets map[int32]int64) []kafka.TopicPartition {
+	partitions := make([]kafka.TopicPartition, 0, len(ids))
+	for _, id := range ids {
+		offset := int64(0)
+		if v, ok := offsets[id]; ok {
+			offset = v + 1
+		}
 		partitions = append(partitions, kafka.TopicPartition{
-			Topic:     &config.Topic,
-			Partition: k,
-			Offset:    kafka.Offset(v + 1),
+			Topic:     &topic,
+			Partition: id,
+			Offset:    kafka.Offset(offset),
 		})
 	}
-	if len(partitions) > 0 {
-		_, err := c.CommitOffsets(partitions)
-		if err != nil {
-			return err
+	return partitions
+}
+
+// continuationOffsets adds the partitions that were not read to the offsets of the read, with their offset from
+// the since token, or the resolved start of partitions positioned at latest or a timestamp.
+func continuationOffsets(read map[int32]int64, offsets map[int32]int64, started map[int32]int64) map[int32]int64 {
+	for p, offset := range offsets {
+		if _, ok := read[p]; !ok {
+			read[p] = offset
 		}
-	} else {
-		// we have no since token, reset to the start
-		m, err := c.GetMetadata(&config.Topic, false, 1000)
+	}
+	// partitions started from latest or a timestamp must be part of the token, otherwise the
+	// next request would resolve the position again and skip whatever was written in between
+	for p, offset := range started {
+		if _, ok := read[p]; !ok {
+			read[p] = offset
+		}
+	}
+	return read
+}
+
+// positionOffsets resolves the given position into concrete offsets for each partition.
+func (consumers *Consumers) positionOffsets(position *conf.Position, topic string, ids []int32, c *kafka.Consumer) ([]kafka.TopicPartition, error) {
+	partitions := make([]kafka.TopicPartition, 0, len(ids))
+	switch position.Kind {
+	case conf.PositionLatest:
+		for _, id := range ids {
+			_, high, err := c.QueryWatermarkOffsets(topic, id, 5000)
+			if err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: id, Offset: kafka.Offset(high)})
+		}
+	case conf.PositionTimestamp:
+		ts := kafka.Offset(position.Timestamp.UnixMilli())
+		query := make([]kafka.TopicPartition, 0, len(ids))
+		for _, id := range ids {
+			query = append(query, kafka.TopicPartition{Topic: &topic, Partition: id, Offset: ts})
+		}
+		found, err := c.OffsetsForTimes(query, 5000)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		for k, v := range m.Topics {
-			if k == config.Topic {
-				for _, p := range v.Partitions {
-					consumers.logger.Infof("Resetting tp %d on %s to 0", p.ID, config.Topic)
-					partitions = append(partitions, kafka.TopicPartition{
-						Topic:     &config.Topic,
-						Partition: p.ID,
-						Offset:    kafka.Offset(0),
-					})
-				}
-				_, err = c.CommitOffsets(partitions)
+		for _, p := range found {
+			if p.Error != nil {
+				return nil, p.Error
+			}
+			if p.Offset < 0 {
+				// no messages at or after the timestamp, so start at the end of the partition
+				_, high, err := c.QueryWatermarkOffsets(topic, p.Partition, 5000)
 				if err != nil {
-					return err
+					return nil, err
 				}
+				p.Offset = kafka.Offset(high)
 			}
+			partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: p.Partition, Offset: p.Offset})
+		}
+	default:
+		for _, id := range ids {
+			partitions = append(partitions, kafka.TopicPartition{Topic: &topic, Partition: id, Offset: kafka.Offset(0)})
 		}
 	}
-	return nil
+	return partitions, nil
 }
 
 func since(partitions map[int32]int64) (string, error) {
@@ -356,6 +777,17 @@ func since(partitions map[int32]int64) (string, error) {
 	return enc, nil
 }
 
+// isFullSyncMarker reports whether the message marks the start or end of a full sync. Markers are not entities,
+// but are part of the continuation token.
+func isFullSyncMarker(msg *kafka.Message) bool {
+	for _, h := range msg.Headers {
+		if h.Key == FullSyncMarkerHeader {
+			return true
+		}
+	}
+	return false
+}
+
 func decodeSince(since string) map[int32]int64 {
 	paritionOffsets := make(map[int32]int64)
 	if since == "" {
@@ -372,4 +804,4 @@ func decodeSince(since string) map[int32]int64 {
 	}
 	return paritionOffsets
 
-}
\ No newline at end of file
+}
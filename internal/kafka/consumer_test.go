@@ -0,0 +1,544 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// mockCluster starts an in-process librdkafka mock cluster with the given topics, each with two partitions.
+func mockCluster(t *testing.T, topics ...string) (*kafka.MockCluster, *conf.Env) {
+	t.Helper()
+	mc, err := kafka.NewMockCluster(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mc.Close)
+	for _, topic := range topics {
+		if err = mc.CreateTopic(topic, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := &conf.Env{
+		Logger:       zap.NewNop().Sugar(),
+		ServiceName:  "test",
+		KafkaBrokers: []string{mc.BootstrapServers()},
+		StateDir:     t.TempDir(),
+	}
+	return mc, env
+}
+
+// readAll reads the messages of a topic partition from the beginning, until it has waited a second for more.
+func readAll(t *testing.T, env *conf.Env, topic string, partition int32) []*kafka.Message {
+	t.Helper()
+	c, err := kafka.NewConsumer(clientConfig(env, kafka.ConfigMap{"group.id": "test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	err = c.Assign([]kafka.TopicPartition{{Topic: &topic, Partition: partition, Offset: kafka.OffsetBeginning}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	low, high, err := c.QueryWatermarkOffsets(topic, partition, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if low >= high {
+		return []*kafka.Message{}
+	}
+	// reads up to the high watermark, the position also moves past transaction markers
+	messages := make([]*kafka.Message, 0)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		msg, err := c.ReadMessage(time.Second)
+		if err == nil {
+			messages = append(messages, msg)
+		}
+		position, err := c.Position([]kafka.TopicPartition{{Topic: &topic, Partition: partition}})
+		if err == nil && position[0].Offset >= kafka.Offset(high) {
+			return messages
+		}
+	}
+	t.Fatalf("could not read %s[%d] up to offset %d", topic, partition, high)
+	return nil
+}
+
+// produce writes the values to a partition of the topic.
+func produce(t *testing.T, env *conf.Env, topic string, partition int32, values ...string) {
+	t.Helper()
+	p, err := kafka.NewProducer(clientConfig(env, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	delivery := make(chan kafka.Event, len(values))
+	for _, v := range values {
+		err = p.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition},
+			Value:          []byte(v),
+		}, delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range values {
+		if m, ok := (<-delivery).(*kafka.Message); !ok || m.TopicPartition.Error != nil {
+			t.Fatalf("could not produce to %s: %v", topic, m)
+		}
+	}
+}
+
+// startConsumers starts consumers with the given configs, they are stopped when the test ends.
+func startConsumers(t *testing.T, env *conf.Env, configs ...conf.ConsumerConfig) (*Consumers, *fxtest.Lifecycle) {
+	t.Helper()
+	lc := fxtest.NewLifecycle(t)
+	mngr := &conf.ConfigurationManager{Datalayer: &conf.KafkaConfig{Consumers: configs}}
+	consumers, err := NewConsumers(lc, env, mngr, &statsd.NoOpClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.RequireStart()
+	t.Cleanup(func() {
+		lc.RequireStop()
+	})
+	return consumers, lc
+}
+
+// changes reads the dataset, and returns the ids of the entities and the continuation token.
+func changes(consumers *Consumers, request DatasetRequest) ([]string, string, error) {
+	ids := make([]string, 0)
+	token := ""
+	err := consumers.ChangeSet(request, func(entity *coder.Entity) {
+		if entity.ID == "@continuation" {
+			token = entity.Properties["token"].(string)
+		} else {
+			ids = append(ids, entity.ID)
+		}
+	})
+	sort.Strings(ids)
+	return ids, token, err
+}
+
+func TestSinceTokens(t *testing.T) {
+	token, err := since(map[int32]int64{0: 41, 3: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := decodeSince(token)
+	if len(offsets) != 2 || offsets[0] != 41 || offsets[3] != 7 {
+		t.Errorf("expected the offsets back from the token, got %v", offsets)
+	}
+	for _, invalid := range []string{"", "not base64!", "bm90IGpzb24="} {
+		if offsets = decodeSince(invalid); len(offsets) != 0 {
+			t.Errorf("expected no offsets from %q, got %v", invalid, offsets)
+		}
+	}
+
+	partitions := sinceOffsets("people", []int32{0, 1, 2}, map[int32]int64{0: 41, 2: 7, 5: 3})
+	expected := []kafka.Offset{42, 0, 8}
+	if len(partitions) != len(expected) {
+		t.Fatalf("expected an offset for every partition of the topic, got %v", partitions)
+	}
+	for i, p := range partitions {
+		if *p.Topic != "people" || p.Partition != int32(i) || p.Offset != expected[i] {
+			t.Errorf("expected partition %d to continue at %d, got %v", i, expected[i], p)
+		}
+	}
+
+	merged := continuationOffsets(map[int32]int64{0: 50}, map[int32]int64{0: 41, 1: 12}, map[int32]int64{1: 20, 2: 99})
+	if len(merged) != 3 || merged[0] != 50 || merged[1] != 12 || merged[2] != 99 {
+		t.Errorf("expected read offsets first, then the token, then the started partitions, got %v", merged)
+	}
+}
+
+func TestStartOffsets(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	produce(t, env, "people", 0, `{"id": "a"}`, `{"id": "b"}`)
+	produce(t, env, "people", 1, `{"id": "c"}`)
+	consumers := &Consumers{logger: env.Logger}
+	c, err := kafka.NewConsumer(clientConfig(env, kafka.ConfigMap{"group.id": "test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	config := &conf.ConsumerConfig{Topic: "people"}
+
+	partitions, started, err := consumers.startOffsets(nil, &conf.Position{Kind: conf.PositionEarliest}, config, c)
+	if err != nil || len(partitions) != 2 || partitions[0].Offset != 0 || partitions[1].Offset != 0 || len(started) != 0 {
+		t.Errorf("expected all partitions to start at 0, got %v, %v, %v", partitions, started, err)
+	}
+	partitions, started, err = consumers.startOffsets(nil, &conf.Position{Kind: conf.PositionLatest}, config, c)
+	if err != nil || len(partitions) != 2 {
+		t.Fatalf("expected all partitions, got %v, %v", partitions, err)
+	}
+	for _, p := range partitions {
+		high := map[int32]kafka.Offset{0: 2, 1: 1}[p.Partition]
+		if p.Offset != high || started[p.Partition] != int64(high)-1 {
+			t.Errorf("expected partition %d to start at the end, got %v and %v", p.Partition, p, started)
+		}
+	}
+	partitions, started, err = consumers.startOffsets(map[int32]int64{0: 0}, &conf.Position{Kind: conf.PositionLatest}, config, c)
+	if err != nil || partitions[0].Offset != 1 || partitions[1].Offset != 0 || len(started) != 0 {
+		t.Errorf("expected the since token to replace the position, got %v, %v, %v", partitions, started, err)
+	}
+}
+
+func TestStatelessChangeSet(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	produce(t, env, "people", 0, `{"id": "a"}`, `{"id": "b"}`)
+	produce(t, env, "people", 1, `{"id": "c"}`)
+	consumers, _ := startConsumers(t, env, conf.ConsumerConfig{
+		Dataset:    "people",
+		Topic:      "people",
+		GroupId:    "people-group",
+		Stateless:  true,
+		IdTemplate: "{id}",
+	})
+
+	ids, token, err := changes(consumers, DatasetRequest{DatasetName: "people", Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != "a" || ids[2] != "c" {
+		t.Errorf("expected the entities of all partitions, got %v", ids)
+	}
+	if offsets := decodeSince(token); len(offsets) != 2 || offsets[0] != 1 || offsets[1] != 0 {
+		t.Errorf("expected the token to hold the last offset of each partition, got %v", offsets)
+	}
+
+	produce(t, env, "people", 1, `{"id": "d"}`)
+	ids, token, err = changes(consumers, DatasetRequest{DatasetName: "people", Since: token, Limit: -1})
+	if err != nil || len(ids) != 1 || ids[0] != "d" {
+		t.Errorf("expected to continue after the token, got %v, %v", ids, err)
+	}
+	if offsets := decodeSince(token); len(offsets) != 2 || offsets[0] != 1 || offsets[1] != 1 {
+		t.Errorf("expected the token to keep the partitions that were not read, got %v", offsets)
+	}
+
+	// stateless reads leave the consumer group alone
+	c, err := kafka.NewConsumer(clientConfig(env, kafka.ConfigMap{"group.id": "people-group"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	topic := "people"
+	committed, err := c.Committed([]kafka.TopicPartition{{Topic: &topic, Partition: 0}, {Topic: &topic, Partition: 1}}, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range committed {
+		if p.Offset != kafka.OffsetInvalid {
+			t.Errorf("expected no committed offset, got %v", p)
+		}
+	}
+}
+
+// runningRead waits for a read of the consumers to start polling, and returns its state.
+func runningRead(t *testing.T, consumers *Consumers) *runState {
+	t.Helper()
+	return runningReads(t, consumers, 1)[0]
+}
+
+// runningReads waits for n reads of the consumers to be running, and returns their states.
+func runningReads(t *testing.T, consumers *Consumers, n int) []*runState {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		consumers.lock.RLock()
+		states := make([]*runState, 0, len(consumers.running))
+		for _, state := range consumers.running {
+			states = append(states, state)
+		}
+		consumers.lock.RUnlock()
+		if len(states) == n {
+			return states
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d running reads", n)
+	return nil
+}
+
+// countingStatsd counts the increments of each metric.
+type countingStatsd struct {
+	statsd.NoOpClient
+	lock   sync.Mutex
+	counts map[string]int64
+}
+
+func (c *countingStatsd) Incr(name string, _ []string, _ float64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[name]++
+	return nil
+}
+
+func TestChangeSetSkipped(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	produce(t, env, "people", 0, `{"id": "a"}`, `{"name": "no id"}`)
+	consumers, _ := startConsumers(t, env, conf.ConsumerConfig{
+		Dataset:    "people",
+		Topic:      "people",
+		Stateless:  true,
+		IdTemplate: "{id}",
+	})
+	counter := &countingStatsd{counts: make(map[string]int64)}
+	consumers.statsd = counter
+
+	ids, token, err := changes(consumers, DatasetRequest{DatasetName: "people", Limit: -1})
+	if err != nil || len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("expected the message without id to be skipped, got %v, %v", ids, err)
+	}
+	if offsets := decodeSince(token); offsets[0] != 1 {
+		t.Errorf("expected the skipped message to be part of the token, got %v", offsets)
+	}
+	if counter.counts["kafka.skipped"] != 1 || counter.counts["kafka.read"] != 2 {
+		t.Errorf("expected the skipped message to be counted, got %v", counter.counts)
+	}
+}
+
+func TestChangeSetClientGone(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	consumers, _ := startConsumers(t, env, conf.ConsumerConfig{
+		Dataset:    "people",
+		Topic:      "people",
+		GroupId:    "people-group",
+		IdTemplate: "{id}",
+	})
+
+	// the topic is empty, so the read waits for data until the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := changes(consumers, DatasetRequest{Context: ctx, DatasetName: "people", Limit: -1})
+		done <- err
+	}()
+	state := runningRead(t, consumers)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the read to end without error, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the read to stop when the client went away")
+	}
+	consumers.lock.RLock()
+	defer consumers.lock.RUnlock()
+	if len(consumers.running) != 0 {
+		t.Errorf("expected the read to be removed, got %v", consumers.running)
+	}
+	if err := state.consumer.Close(); err == nil {
+		t.Error("expected the consumer to be closed")
+	}
+}
+
+func TestChangeSetGroups(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	consumers, _ := startConsumers(t, env,
+		conf.ConsumerConfig{Dataset: "people", Topic: "people", GroupId: "people-group", Stateless: true},
+		conf.ConsumerConfig{Dataset: "people-a", Topic: "people", GroupId: "people-group"},
+		conf.ConsumerConfig{Dataset: "people-b", Topic: "people"},
+		conf.ConsumerConfig{Dataset: "people-c", Topic: "people"},
+	)
+
+	// the topic is empty, so the reads keep waiting for data until the request is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	var reads sync.WaitGroup
+	for i, dataset := range []string{"people", "people-a", "people-b", "people-c"} {
+		reads.Add(1)
+		go func() {
+			defer reads.Done()
+			_, _, _ = changes(consumers, DatasetRequest{Context: ctx, DatasetName: dataset, Limit: -1})
+		}()
+		runningReads(t, consumers, i+1)
+	}
+
+	// a group read does not cancel stateless reads, or reads of other groups on the same topic
+	for _, state := range runningReads(t, consumers, 4) {
+		if state.ctx.Err() != nil {
+			t.Errorf("expected the read of %s to keep running", state.dataset)
+		}
+	}
+	cancel()
+	reads.Wait()
+}
+
+func TestChangeSetShutdown(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	produce(t, env, "people", 0, `{"id": "a"}`, `{"id": "b"}`)
+	consumers, lc := startConsumers(t, env, conf.ConsumerConfig{
+		Dataset:    "people",
+		Topic:      "people",
+		GroupId:    "people-group",
+		IdTemplate: "{id}",
+	})
+
+	var ids []string
+	token := ""
+	stopped := make(chan error, 1)
+	err := consumers.ChangeSet(DatasetRequest{DatasetName: "people", Limit: -1}, func(entity *coder.Entity) {
+		if entity.ID == "@continuation" {
+			token = entity.Properties["token"].(string)
+			return
+		}
+		ids = append(ids, entity.ID)
+		if len(ids) == 1 {
+			// shut down after the first entity, and wait for the read to be cancelled
+			state := runningRead(t, consumers)
+			go func() {
+				stopped <- lc.Stop(context.Background())
+			}()
+			<-state.ctx.Done()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("expected the read to stop after the first entity, got %v", ids)
+	}
+	if offsets := decodeSince(token); len(offsets) != 1 || offsets[0] != 0 {
+		t.Errorf("expected a continuation token for the sent entity, got %q (%v)", token, offsets)
+	}
+	if err = consumers.Preflight("people"); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("expected new reads to be rejected, got %v", err)
+	}
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	topic := "people"
+	config := &conf.ConsumerConfig{Dataset: "people", DeadLetterTopic: "people.dlq"}
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 42},
+		Key:            []byte("k1"),
+		Value:          []byte("not json"),
+		Headers:        []kafka.Header{{Key: "tenant", Value: []byte("acme")}},
+	}
+
+	dlq := deadLetterMessage(config, msg, errors.New("broken"))
+	if *dlq.TopicPartition.Topic != "people.dlq" || dlq.TopicPartition.Partition != kafka.PartitionAny {
+		t.Errorf("expected the message to go to any partition of people.dlq, got %v", dlq.TopicPartition)
+	}
+	if string(dlq.Key) != "k1" || string(dlq.Value) != "not json" {
+		t.Errorf("expected the raw key and value to be kept, got %s: %s", dlq.Key, dlq.Value)
+	}
+	expected := map[string]string{
+		"tenant":        "acme",
+		"dlq.dataset":   "people",
+		"dlq.topic":     "people",
+		"dlq.partition": "1",
+		"dlq.offset":    "42",
+		"dlq.error":     "broken",
+	}
+	if len(dlq.Headers) != len(expected) {
+		t.Errorf("expected %d headers, got %v", len(expected), dlq.Headers)
+	}
+	for _, h := range dlq.Headers {
+		if expected[h.Key] != string(h.Value) {
+			t.Errorf("expected header %s to be %q, got %q", h.Key, expected[h.Key], h.Value)
+		}
+	}
+}
+
+func TestHandleDecodeError(t *testing.T) {
+	mc, env := mockCluster(t, "people.dlq")
+	consumers := &Consumers{env: env, logger: env.Logger, lock: &sync.RWMutex{}}
+	t.Cleanup(func() {
+		if consumers.dlqProducer != nil {
+			consumers.dlqProducer.Close()
+		}
+	})
+	topic := "people"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 7},
+		Key:            []byte("k1"),
+		Value:          []byte{1, 2, 3},
+	}
+	decodeErr := errors.New("not avro")
+
+	t.Run("fails by default", func(t *testing.T) {
+		err := consumers.handleDecodeError(context.Background(), &conf.ConsumerConfig{}, msg, decodeErr)
+		if !errors.Is(err, decodeErr) {
+			t.Errorf("expected the decode error, got %v", err)
+		}
+		err = consumers.handleMappingError(context.Background(), &conf.ConsumerConfig{OnMappingError: conf.OnMappingErrorFail}, msg, decodeErr)
+		if !errors.Is(err, decodeErr) {
+			t.Errorf("expected the mapping error, got %v", err)
+		}
+	})
+	t.Run("skips", func(t *testing.T) {
+		err := consumers.handleDecodeError(context.Background(), &conf.ConsumerConfig{OnDecodeError: conf.OnDecodeErrorSkip}, msg, decodeErr)
+		if err != nil {
+			t.Errorf("expected the message to be skipped, got %v", err)
+		}
+		err = consumers.handleMappingError(context.Background(), &conf.ConsumerConfig{OnMappingError: conf.OnMappingErrorSkip}, msg, decodeErr)
+		if err != nil {
+			t.Errorf("expected the message to be skipped, got %v", err)
+		}
+	})
+	t.Run("dead-letters", func(t *testing.T) {
+		config := &conf.ConsumerConfig{
+			Dataset:         "people",
+			OnDecodeError:   conf.OnDecodeErrorDeadLetter,
+			DeadLetterTopic: "people.dlq",
+		}
+		if err := consumers.handleDecodeError(context.Background(), config, msg, decodeErr); err != nil {
+			t.Fatal(err)
+		}
+		var written []*kafka.Message
+		for p := int32(0); p < 2; p++ {
+			written = append(written, readAll(t, env, "people.dlq", p)...)
+		}
+		if len(written) != 1 || string(written[0].Key) != "k1" {
+			t.Fatalf("expected the message on the dead letter topic, got %v", written)
+		}
+		for _, h := range written[0].Headers {
+			if h.Key == "dlq.error" && string(h.Value) != "not avro" {
+				t.Errorf("expected the decode error in the headers, got %s", h.Value)
+			}
+		}
+	})
+	t.Run("fails when the read ends before the delivery", func(t *testing.T) {
+		config := &conf.ConsumerConfig{
+			Dataset:         "people",
+			OnDecodeError:   conf.OnDecodeErrorDeadLetter,
+			DeadLetterTopic: "people.dlq",
+		}
+		_ = mc.SetBrokerDown(1)
+		defer func() {
+			_ = mc.SetBrokerUp(1)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := consumers.handleDecodeError(ctx, config, msg, decodeErr); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the read context to end the wait, got %v", err)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("expected to stop waiting when the read ends, waited %v", time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,520 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	kgo "github.com/segmentio/kafka-go"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+const (
+	// FullSyncMarkerHeader is set on the marker messages written at the start and end of a full sync
+	FullSyncMarkerHeader = "uda-full-sync"
+	FullSyncIdHeader     = "uda-full-sync-id"
+
+	fullSyncStart = "start"
+	fullSyncEnd   = "end"
+)
+
+var ErrUnknownFullSync = errors.New("full sync is not running")
+
+// FullSync describes how a request takes part in a full sync, as given by the universal-data-api-full-sync-*
+// headers. A full sync spans one or more requests with the same id, from the one with Start to the one with End.
+type FullSync struct {
+	Id    string
+	Start bool
+	End   bool
+}
+
+// syncSession is a running full sync of a dataset. Topic is the versioned topic the sync writes to, and LiveKeys
+// the size of the live key file when a sync with tombstones started. Sessions are saved in the state dir, so a
+// sync can be continued after a restart.
+type syncSession struct {
+	Id       string `json:"id"`
+	Topic    string `json:"topic,omitempty"`
+	LiveKeys int64  `json:"liveKeys,omitempty"`
+}
+
+// prepareSync starts or continues the full sync of the request, and returns the config to write the batch with.
+// Datasets without fullSync settings treat full syncs like any other request.
+func (producers *Producers) prepareSync(config *conf.ProducerConfig, sync *FullSync) (*conf.ProducerConfig, *syncSession, error) {
+	if config.FullSync == nil {
+		return config, nil, nil
+	}
+	if sync == nil {
+		if config.FullSync.Strategy == conf.FullSyncVersionedTopic {
+			// writes between full syncs go to the topic of the last completed sync
+			topic, err := producers.currentTopic(config)
+			if err != nil {
+				return nil, nil, err
+			}
+			return withTopic(config, topic), nil, nil
+		}
+		return config, nil, nil
+	}
+
+	var session *syncSession
+	if sync.Start {
+		var err error
+		session, err = producers.startSync(config, sync.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		producers.lock.Lock()
+		producers.syncs[config.Dataset] = session
+		producers.lock.Unlock()
+	} else {
+		producers.lock.Lock()
+		session = producers.syncs[config.Dataset]
+		producers.lock.Unlock()
+		if session == nil {
+			// the sync may have been started before a restart
+			var err error
+			session, err = producers.loadSession(config)
+			if err != nil {
+				return nil, nil, err
+			}
+			if session != nil {
+				producers.lock.Lock()
+				producers.syncs[config.Dataset] = session
+				producers.lock.Unlock()
+			}
+		}
+		if session == nil || session.Id != sync.Id {
+			return nil, nil, fmt.Errorf("%w: %s for dataset %s", ErrUnknownFullSync, sync.Id, config.Dataset)
+		}
+	}
+	if session.Topic != "" {
+		return withTopic(config, session.Topic), session, nil
+	}
+	return config, session, nil
+}
+
+func withTopic(config *conf.ProducerConfig, topic string) *conf.ProducerConfig {
+	if topic == config.Topic {
+		return config
+	}
+	c := *config
+	c.Topic = topic
+	return &c
+}
+
+func (producers *Producers) startSync(config *conf.ProducerConfig, id string) (*syncSession, error) {
+	producers.log.Infof("Starting full sync %s of %s with strategy %s", id, config.Dataset, config.FullSync.Strategy)
+	session := &syncSession{Id: id}
+	var err error
+	switch config.FullSync.Strategy {
+	case conf.FullSyncMarkers:
+		err = producers.writeMarkers(config, id, fullSyncStart)
+	case conf.FullSyncVersionedTopic:
+		session.Topic = fmt.Sprintf("%s.v%d", config.Topic, time.Now().UnixMilli())
+		err = producers.createVersionedTopic(config, session.Topic)
+	case conf.FullSyncTombstones:
+		err = producers.resetSyncKeys(config, session)
+	default:
+		return nil, fmt.Errorf("unsupported full sync strategy %q", config.FullSync.Strategy)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, producers.saveSession(config, session)
+}
+
+// resetSyncKeys empties the keys seen by the sync, and notes where the keys written by other requests during
+// the sync start in the live key file.
+func (producers *Producers) resetSyncKeys(config *conf.ProducerConfig, session *syncSession) error {
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+	info, err := os.Stat(producers.stateFile(config, "live.keys"))
+	if err == nil {
+		session.LiveKeys = info.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeKeys(producers.stateFile(config, "sync.keys"), nil)
+}
+
+func (producers *Producers) saveSession(config *conf.ProducerConfig, session *syncSession) error {
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+	content, _ := json.Marshal(session)
+	file := producers.stateFile(config, "sync")
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0o644)
+}
+
+// loadSession returns the saved session of the dataset, or nil if no sync is running.
+func (producers *Producers) loadSession(config *conf.ProducerConfig) (*syncSession, error) {
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+	content, err := os.ReadFile(producers.stateFile(config, "sync"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &syncSession{}
+	if err = json.Unmarshal(content, session); err != nil {
+		return nil, fmt.Errorf("corrupt full sync state of %s: %w", config.Dataset, err)
+	}
+	return session, nil
+}
+
+// finishSync completes the full sync after its last batch is written.
+func (producers *Producers) finishSync(config *conf.ProducerConfig, session *syncSession) error {
+	var err error
+	switch config.FullSync.Strategy {
+	case conf.FullSyncMarkers:
+		err = producers.writeMarkers(config, session.Id, fullSyncEnd)
+	case conf.FullSyncVersionedTopic:
+		err = producers.swapAlias(config, session)
+	case conf.FullSyncTombstones:
+		err = producers.deleteUnseen(config, session)
+	}
+	if err != nil {
+		return err
+	}
+
+	producers.stateLock.Lock()
+	err = os.Remove(producers.stateFile(config, "sync"))
+	producers.stateLock.Unlock()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	producers.lock.Lock()
+	if producers.syncs[config.Dataset] == session {
+		delete(producers.syncs, config.Dataset)
+	}
+	producers.lock.Unlock()
+	producers.log.Infof("Completed full sync %s of %s", session.Id, config.Dataset)
+	return nil
+}
+
+// writeMarkers writes a marker to each partition of the topic, so every consumer sees the sync boundary.
+func (producers *Producers) writeMarkers(config *conf.ProducerConfig, id string, marker string) error {
+	topic := config.Topic
+	m, err := producers.adminClient.GetMetadata(&topic, false, 5000)
+	if err != nil {
+		return err
+	}
+	t, ok := m.Topics[topic]
+	if !ok || len(t.Partitions) == 0 {
+		return fmt.Errorf("%w: %s", ErrTopicNotFound, topic)
+	}
+
+	value, _ := json.Marshal(map[string]interface{}{
+		"fullSync":   marker,
+		"fullSyncId": id,
+		"dataset":    config.Dataset,
+	})
+	messages := make([]*kafka.Message, len(t.Partitions))
+	for i, p := range t.Partitions {
+		messages[i] = &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: p.ID},
+			Value:          value,
+			Headers: []kafka.Header{
+				{Key: FullSyncMarkerHeader, Value: []byte(marker)},
+				{Key: FullSyncIdHeader, Value: []byte(id)},
+			},
+		}
+	}
+	return producers.produceDirect(messages)
+}
+
+func (producers *Producers) createVersionedTopic(config *conf.ProducerConfig, topic string) error {
+	partitions, replicas := 0, 0
+	topicConfig := make(map[string]string)
+	if config.TopicSettings != nil {
+		partitions, replicas = config.TopicSettings.Partitions, config.TopicSettings.Replicas
+		if config.TopicSettings.Config != nil {
+			for k, v := range *config.TopicSettings.Config {
+				topicConfig[k] = v
+			}
+		}
+	} else {
+		// without topic settings, the versioned topic is laid out like the configured one
+		base := config.Topic
+		m, err := producers.adminClient.GetMetadata(&base, false, 5000)
+		if err != nil {
+			return err
+		}
+		t, ok := m.Topics[base]
+		if !ok || len(t.Partitions) == 0 {
+			return fmt.Errorf("%w: %s, it is needed to lay out versioned topics without topicSettings", ErrTopicNotFound, base)
+		}
+		partitions, replicas = len(t.Partitions), len(t.Partitions[0].Replicas)
+	}
+	if _, ok := topicConfig["retention.ms"]; !ok {
+		topicConfig["retention.ms"] = "-1"
+	}
+
+	results, err := producers.adminClient.CreateTopics(context.Background(), []kafka.TopicSpecification{{
+		Topic:             topic,
+		NumPartitions:     partitions,
+		ReplicationFactor: replicas,
+		Config:            topicConfig,
+	}}, kafka.SetAdminOperationTimeout(60*time.Second))
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError && result.Error.Code() != kafka.ErrTopicAlreadyExists {
+			return fmt.Errorf("could not create topic %s: %w", topic, result.Error)
+		}
+	}
+	return nil
+}
+
+// swapAlias points the alias of the dataset topic to the versioned topic of the completed sync. The alias is a
+// message keyed by the configured topic name on the alias topic, which should be compacted.
+func (producers *Producers) swapAlias(config *conf.ProducerConfig, session *syncSession) error {
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+	original := producers.configForDataset(config.Dataset)
+	if original == nil {
+		return fmt.Errorf("%w: %s", ErrDatasetNotFound, config.Dataset)
+	}
+
+	aliasTopic := config.FullSync.AliasTopic
+	value, _ := json.Marshal(map[string]interface{}{
+		"topic":      session.Topic,
+		"fullSyncId": session.Id,
+		"dataset":    config.Dataset,
+		"completed":  time.Now().UTC().Format(time.RFC3339),
+	})
+	err := producers.produceDirect([]*kafka.Message{{
+		TopicPartition: kafka.TopicPartition{Topic: &aliasTopic, Partition: kafka.PartitionAny},
+		Key:            []byte(original.Topic),
+		Value:          value,
+	}})
+	if err != nil {
+		return err
+	}
+	file := producers.stateFile(config, "topic")
+	if err = os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(session.Topic), 0o644)
+}
+
+// currentTopic is the versioned topic of the last completed full sync, or the configured topic before the first.
+func (producers *Producers) currentTopic(config *conf.ProducerConfig) (string, error) {
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+	content, err := os.ReadFile(producers.stateFile(config, "topic"))
+	if errors.Is(err, os.ErrNotExist) {
+		return config.Topic, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	topic := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(topic, config.Topic+".v") {
+		// the configured topic has changed since the last sync
+		return config.Topic, nil
+	}
+	return topic, nil
+}
+
+// trackKeys records the keys written for datasets with the tombstones strategy. Keys written in a full sync are
+// the keys seen by the sync, other writes update the live keys of the dataset.
+func (producers *Producers) trackKeys(config *conf.ProducerConfig, session *syncSession, data []kgo.Message) error {
+	if config.FullSync == nil || config.FullSync.Strategy != conf.FullSyncTombstones {
+		return nil
+	}
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+
+	lines := make([]string, 0, len(data))
+	for _, m := range data {
+		if m.Key == nil {
+			continue
+		}
+		key := base64.StdEncoding.EncodeToString(m.Key)
+		switch {
+		case session != nil && m.Value != nil:
+			lines = append(lines, key)
+		case session == nil && m.Value != nil:
+			lines = append(lines, "+"+key)
+		case session == nil:
+			lines = append(lines, "-"+key)
+		}
+	}
+	file := producers.stateFile(config, "live.keys")
+	if session != nil {
+		file = producers.stateFile(config, "sync.keys")
+	}
+	return appendLines(file, lines)
+}
+
+// deleteUnseen writes tombstones for the live keys that were not seen in the full sync, and makes the seen keys
+// the live keys. Keys written by other requests while the sync was running are kept.
+func (producers *Producers) deleteUnseen(config *conf.ProducerConfig, session *syncSession) error {
+	producers.stateLock.Lock()
+	defer producers.stateLock.Unlock()
+
+	live, err := readKeys(producers.stateFile(config, "live.keys"), 0)
+	if err != nil {
+		return err
+	}
+	seen, err := readKeys(producers.stateFile(config, "sync.keys"), 0)
+	if err != nil {
+		return err
+	}
+	added, err := readKeys(producers.stateFile(config, "live.keys"), session.LiveKeys)
+	if err != nil {
+		return err
+	}
+	for key := range added {
+		seen[key] = true
+	}
+	tombstones := make([]kgo.Message, 0)
+	for key := range live {
+		if !seen[key] {
+			tombstones = append(tombstones, kgo.Message{Key: []byte(key)})
+		}
+	}
+	if len(tombstones) > 0 {
+		producers.log.Infof("Writing %d tombstones for keys not seen in the full sync of %s", len(tombstones), config.Dataset)
+		if err = producers.write(config, tombstones); err != nil {
+			return err
+		}
+	}
+	if err = writeKeys(producers.stateFile(config, "live.keys"), seen); err != nil {
+		return err
+	}
+	return os.Remove(producers.stateFile(config, "sync.keys"))
+}
+
+func (producers *Producers) stateFile(config *conf.ProducerConfig, name string) string {
+	return filepath.Join(producers.env.StateDir, url.PathEscape(config.Dataset), name)
+}
+
+// produceDirect writes messages with the librdkafka producer, which unlike the writers can target partitions.
+func (producers *Producers) produceDirect(messages []*kafka.Message) error {
+	producers.lock.Lock()
+	if producers.directProducer == nil {
+		p, err := kafka.NewProducer(clientConfig(producers.env, kafka.ConfigMap{
+			"partitioner": "murmur2_random",
+		}))
+		if err != nil {
+			producers.lock.Unlock()
+			return err
+		}
+		go drainEvents(p)
+		producers.directProducer = p
+	}
+	p := producers.directProducer
+	producers.lock.Unlock()
+
+	delivery := make(chan kafka.Event, len(messages))
+	for _, m := range messages {
+		if err := p.Produce(m, delivery); err != nil {
+			return err
+		}
+	}
+	var err error
+	for range messages {
+		if m, ok := (<-delivery).(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			err = m.TopicPartition.Error
+		}
+	}
+	return err
+}
+
+// readKeys reads a key file from the given byte offset. Lines are base64 encoded keys, optionally prefixed with
+// + or - to add or remove them.
+func readKeys(file string, offset int64) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		remove := line[0] == '-'
+		line = strings.TrimLeft(line, "+-")
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt key file %s: %w", file, err)
+		}
+		if remove {
+			delete(keys, string(key))
+		} else {
+			keys[string(key)] = true
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// writeKeys replaces the key file with the given keys.
+func writeKeys(file string, keys map[string]bool) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key := range keys {
+		_, _ = w.WriteString(base64.StdEncoding.EncodeToString([]byte(key)) + "\n")
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func appendLines(file string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
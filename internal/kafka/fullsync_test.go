@@ -0,0 +1,166 @@
+package kafka
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	kgo "github.com/segmentio/kafka-go"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// testProducers returns producers for the given env, without the admin client and the lifecycle hooks.
+func testProducers(env *conf.Env, configs ...conf.ProducerConfig) *Producers {
+	return &Producers{
+		log:              env.Logger,
+		env:              env,
+		bootstrapServers: env.KafkaBrokers,
+		writers:          newWriterRegistry(env.Logger, env.KafkaBrokers, &kgo.Transport{}),
+		transactions:     make(map[string]*txProducer),
+		syncs:            make(map[string]*syncSession),
+		encoders:         make(map[string]coder.ValueEncoder),
+		configs:          configs,
+		statsd:           &statsd.NoOpClient{},
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "people", "live.keys")
+
+	keys, err := readKeys(file, 0)
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys from a missing file, got %v, %v", keys, err)
+	}
+	if err = writeKeys(file, map[string]bool{"a": true, "b\nc": true}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = readKeys(file, 0)
+	if err != nil || len(keys) != 2 || !keys["a"] || !keys["b\nc"] {
+		t.Fatalf("expected the written keys, got %v, %v", keys, err)
+	}
+
+	info, _ := os.Stat(file)
+	if err = appendLines(file, []string{"+ZA==", "-YQ==", "+ZQ==", "-ZQ=="}); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = readKeys(file, 0)
+	if len(keys) != 2 || keys["a"] || !keys["d"] {
+		t.Errorf("expected a to be removed and d to be added, got %v", keys)
+	}
+	keys, _ = readKeys(file, info.Size())
+	if len(keys) != 1 || !keys["d"] {
+		t.Errorf("expected only the keys added after the offset, got %v", keys)
+	}
+
+	if err = appendLines(file, []string{"not base64!"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readKeys(file, 0); err == nil {
+		t.Error("expected an error for a corrupt key file")
+	}
+}
+
+func TestTrackKeys(t *testing.T) {
+	_, env := mockCluster(t)
+	producers := testProducers(env)
+	config := &conf.ProducerConfig{Dataset: "people", FullSync: &conf.FullSyncSettings{Strategy: conf.FullSyncTombstones}}
+
+	err := producers.trackKeys(config, nil, []kgo.Message{
+		{Key: []byte("a"), Value: []byte("{}")},
+		{Key: []byte("b"), Value: []byte("{}")},
+		{Key: []byte("a")},
+		{Value: []byte("{}")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = producers.trackKeys(config, &syncSession{Id: "sync-1"}, []kgo.Message{
+		{Key: []byte("c"), Value: []byte("{}")},
+		{Key: []byte("d")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, _ := readKeys(producers.stateFile(config, "live.keys"), 0)
+	if len(live) != 1 || !live["b"] {
+		t.Errorf("expected b to be live, got %v", live)
+	}
+	seen, _ := readKeys(producers.stateFile(config, "sync.keys"), 0)
+	if len(seen) != 1 || !seen["c"] {
+		t.Errorf("expected the sync to have seen c, got %v", seen)
+	}
+
+	untracked := &conf.ProducerConfig{Dataset: "pets", FullSync: &conf.FullSyncSettings{Strategy: conf.FullSyncMarkers}}
+	if err = producers.trackKeys(untracked, nil, []kgo.Message{{Key: []byte("a"), Value: []byte("{}")}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(producers.stateFile(untracked, "live.keys")); !os.IsNotExist(err) {
+		t.Error("expected keys to be tracked only for the tombstones strategy")
+	}
+}
+
+func TestDeleteUnseen(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	config := conf.ProducerConfig{
+		Dataset:      "people",
+		Topic:        "people",
+		BatchTimeout: "10ms",
+		FullSync:     &conf.FullSyncSettings{Strategy: conf.FullSyncTombstones},
+	}
+	producers := testProducers(env, config)
+	t.Cleanup(func() {
+		producers.writers.closeAll()
+	})
+	write := func(sync *FullSync, keys ...string) {
+		t.Helper()
+		batch, err := producers.Begin(context.Background(), "people", sync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer batch.Abort()
+		data := make([]kgo.Message, len(keys))
+		for i, key := range keys {
+			data[i] = kgo.Message{Key: []byte(key), Value: []byte("{}")}
+		}
+		if err = producers.trackKeys(batch.config, batch.session, data); err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(nil, "a", "b", "c")
+	write(&FullSync{Id: "sync-1", Start: true}, "a")
+	write(nil, "d")
+
+	// the sync continues after a restart
+	producers.writers.closeAll()
+	producers = testProducers(env, config)
+	write(&FullSync{Id: "sync-1", End: true}, "b")
+
+	live, _ := readKeys(producers.stateFile(&config, "live.keys"), 0)
+	if len(live) != 3 || !live["a"] || !live["b"] || !live["d"] {
+		t.Errorf("expected the keys of the sync and the key written during it to be live, got %v", live)
+	}
+	if _, err := os.Stat(producers.stateFile(&config, "sync")); !os.IsNotExist(err) {
+		t.Error("expected the completed sync to be removed from the state dir")
+	}
+
+	var tombstones []string
+	for p := int32(0); p < 2; p++ {
+		for _, m := range readAll(t, env, "people", p) {
+			if m.Value == nil {
+				tombstones = append(tombstones, string(m.Key))
+			}
+		}
+	}
+	if len(tombstones) != 1 || tombstones[0] != "c" {
+		t.Errorf("expected a tombstone for c only, got %v", tombstones)
+	}
+}
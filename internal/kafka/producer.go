@@ -2,14 +2,13 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/hashicorp/go-uuid"
 	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
 	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
 	kgo "github.com/segmentio/kafka-go"
@@ -17,13 +16,26 @@ import (
 	"go.uber.org/zap"
 )
 
+// ErrEncoding is wrapped by errors of entities that cannot be written with the dataset config, like entities
+// without a value for the key or that do not match the schema. Other produce errors are write failures.
+var ErrEncoding = errors.New("could not encode entity")
+
 type Producers struct {
 	log              *zap.SugaredLogger
 	env              *conf.Env
 	bootstrapServers []string
 	adminClient      *kafka.AdminClient
-	producers        map[string]*kgo.Writer
-	mngr             *conf.ConfigurationManager
+	writers          *writerRegistry
+	lock             sync.Mutex
+	closing          bool
+	writes           sync.WaitGroup
+	transactions     map[string]*txProducer
+	syncs            map[string]*syncSession
+	directProducer   *kafka.Producer
+	stateLock        sync.Mutex
+	encoders         map[string]coder.ValueEncoder
+	encoderLock      sync.Mutex
+	configs          []conf.ProducerConfig
 	statsd           statsd.ClientInterface
 }
 
@@ -32,118 +44,190 @@ func NewProducers(lc fx.Lifecycle, env *conf.Env, mngr *conf.ConfigurationManage
 		log:              env.Logger.Named("producers"),
 		env:              env,
 		bootstrapServers: env.KafkaBrokers,
-		producers:        make(map[string]*kgo.Writer),
-		mngr:             mngr,
+		encoders:         make(map[string]coder.ValueEncoder),
+		transactions:     make(map[string]*txProducer),
+		syncs:            make(map[string]*syncSession),
 		statsd:           statsd,
 	}
 
 	onUpdate := func(digest [16]byte) {
-		err := producers.initTopics(mngr.Datalayer.Producers)
+		configs := producers.update(mngr.Datalayer)
+		producers.encoderLock.Lock()
+		producers.encoders = make(map[string]coder.ValueEncoder)
+		producers.encoderLock.Unlock()
+		producers.writers.retain(configs)
+		producers.retainTransactions(configs)
+		err := producers.initTopics(configs)
 		if err != nil {
 			producers.log.Warn(err)
 		}
 	}
 
-	a, err := kafka.NewAdminClient(&kafka.ConfigMap{"bootstrap.servers": strings.Join(producers.bootstrapServers, ",")})
+	a, err := kafka.NewAdminClient(clientConfig(env, nil))
 	if err != nil {
 		return nil, err
 	}
 	producers.adminClient = a
 
+	transport, err := newTransport(env)
+	if err != nil {
+		return nil, err
+	}
+	producers.writers = newWriterRegistry(producers.log, env.KafkaBrokers, transport)
+
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
 			mngr.AddConfigUpdateListener(onUpdate)
-			if mngr.Datalayer.Producers != nil && len(mngr.Datalayer.Producers) > 0 {
-				return producers.initTopics(mngr.Datalayer.Producers)
+			if configs := producers.update(mngr.Datalayer); len(configs) > 0 {
+				return producers.initTopics(configs)
 			}
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
+			// new writes are rejected, running writes are allowed to finish before the writers are flushed
+			producers.lock.Lock()
+			producers.closing = true
+			producers.lock.Unlock()
+
+			producers.log.Info("Waiting for running writes to finish")
+			err := wait(ctx, &producers.writes)
+			if err != nil {
+				producers.log.Warnf("Gave up waiting for running writes: %v", err)
+			}
+
+			producers.writers.closeAll()
+			if closeErr := producers.closeTransactions(ctx); closeErr != nil {
+				producers.log.Warnf("Gave up waiting for running transactions: %v", closeErr)
+				err = closeErr
+			}
+			producers.lock.Lock()
+			if producers.directProducer != nil {
+				producers.directProducer.Flush(5000)
+				producers.directProducer.Close()
+			}
+			producers.lock.Unlock()
+
 			producers.log.Info("Stopping admin client")
 			a.Close()
-			return nil
+			return err
 		},
 	})
 
 	return producers, nil
 }
 
-func (producers *Producers) DoesDatasetExist(datasetName string) bool {
-	if producers.mngr.Datalayer.Producers == nil {
-		return false
+// update replaces the producer configs that writes are looked up in, and returns them. The config manager
+// replaces its config on reloads, so it is only read here.
+func (producers *Producers) update(config *conf.KafkaConfig) []conf.ProducerConfig {
+	var configs []conf.ProducerConfig
+	if config != nil {
+		configs = config.Producers
 	}
+	producers.lock.Lock()
+	defer producers.lock.Unlock()
+	producers.configs = configs
+	return configs
+}
 
-	for _, c := range producers.mngr.Datalayer.Producers {
-		if c.Dataset == datasetName {
-			return true
-		}
-	}
-	return false
+func (producers *Producers) DoesDatasetExist(datasetName string) bool {
+	return producers.configForDataset(datasetName) != nil
 }
 
+// ProduceEntities writes the entities in a batch of their own.
 func (producers *Producers) ProduceEntities(datasetName string, ctx *coder.Context, entities []*coder.Entity) error {
-	config := producers.configForDataset(datasetName)
-
-	var w *kgo.Writer
-	if prod, ok := producers.producers[datasetName]; !ok {
-		w = &kgo.Writer{
-			Addr:     kgo.TCP(producers.bootstrapServers...),
-			Topic:    config.Topic,
-			Balancer: kgo.Murmur2Balancer{},
-		}
-		producers.producers[datasetName] = w
-	} else {
-		w = prod
+	batch, err := producers.Begin(context.Background(), datasetName, nil)
+	if err != nil {
+		return err
+	}
+	defer batch.Abort()
+	if err = batch.Produce(ctx, entities); err != nil {
+		return err
 	}
+	return batch.Commit()
+}
 
+// write writes the messages with the shared writer of the dataset.
+func (producers *Producers) write(config *conf.ProducerConfig, data []kgo.Message) error {
+	w, release, err := producers.writers.acquire(config)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return w.WriteMessages(context.Background(), data...)
+}
+
+// messages encodes the entities as messages with key and headers.
+func (producers *Producers) messages(config *conf.ProducerConfig, ctx *coder.Context, entities []*coder.Entity) ([]kgo.Message, error) {
 	tags := []string{
 		fmt.Sprintf("application:%s", producers.env.ServiceName),
 		fmt.Sprintf("topic:%s", config.Topic),
 	}
 
+	encoder, err := producers.encoder(config)
+	if err != nil {
+		return nil, err
+	}
+	keys := coder.NewKeyBuilder(config)
+	headers, err := coder.NewHeaderBuilder(config)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
 	data := make([]kgo.Message, len(entities))
 	for i, entity := range entities {
-		var themBytes []byte
-		if config.StripProps {
-			raw, err := entity.StripProps()
-			if err != nil {
-				return err
-			}
-			themBytes = raw
+		key, err := keys.Key(entity)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrEncoding, entity.ID, err)
+		}
+		if entity.IsDeleted && config.DeletedAsTombstone {
+			data[i] = tombstone(entity, key, ctx)
 		} else {
-			entity.Context = ctx.Namespaces
-			raw, err := json.Marshal(entity)
+			themBytes, err := encoder.Encode(entity, ctx)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("%w %s: %w", ErrEncoding, entity.ID, err)
+			}
+			data[i] = kgo.Message{
+				Key:   key,
+				Value: themBytes,
 			}
-			themBytes = raw
 		}
-		data[i] = kgo.Message{
-			Key:   producers.determineKey(entity, config),
-			Value: themBytes,
+		for _, h := range headers.Headers(entity, now) {
+			data[i].Headers = append(data[i].Headers, kgo.Header{Key: h.Key, Value: h.Value})
 		}
 		_ = producers.statsd.Incr("kafka.write", tags, 1)
 	}
-	return w.WriteMessages(context.Background(), data...)
+	return data, nil
 }
 
-func (producers *Producers) determineKey(entity *coder.Entity, config *conf.ProducerConfig) []byte {
-	if config.Key == nil {
-		return nil
+// encoder returns the cached value encoder for the dataset, the cache is reset on config updates.
+func (producers *Producers) encoder(config *conf.ProducerConfig) (coder.ValueEncoder, error) {
+	producers.encoderLock.Lock()
+	defer producers.encoderLock.Unlock()
+	if encoder, ok := producers.encoders[config.Dataset]; ok {
+		return encoder, nil
 	}
-	switch *config.Key {
-	case "id":
-		return []byte(entity.ID)
-	case "uuid":
-		id, _ := uuid.GenerateUUID()
-		return []byte(id)
-	default:
-		return nil
+	encoder, err := coder.NewValueEncoder(config)
+	if err != nil {
+		return nil, err
+	}
+	producers.encoders[config.Dataset] = encoder
+	return encoder, nil
+}
+
+// tombstone is a message without value, which makes compaction remove the earlier records with the same key.
+// It needs a key to do so, so the expanded entity id is used if the dataset has no key configured.
+func tombstone(entity *coder.Entity, key []byte, ctx *coder.Context) kgo.Message {
+	if key == nil {
+		key = coder.TombstoneKey(entity, ctx)
 	}
+	return kgo.Message{Key: key}
 }
 
 func (producers *Producers) configForDataset(datasetName string) *conf.ProducerConfig {
-	for _, c := range producers.mngr.Datalayer.Producers {
+	producers.lock.Lock()
+	defer producers.lock.Unlock()
+	for _, c := range producers.configs {
 		if c.Dataset == datasetName {
 			return &c
 		}
@@ -156,7 +240,9 @@ func (producers *Producers) initTopics(config []conf.ProducerConfig) error {
 	specs := make([]kafka.TopicSpecification, 0)
 	for _, c := range config {
 		producers.log.Info("Verifying topic -> " + c.Topic)
-		if c.CreateTopic {
+		if c.CreateTopic && c.TopicSettings == nil {
+			producers.log.Warnf("Cannot create topic %s without topicSettings", c.Topic)
+		} else if c.CreateTopic {
 			producers.log.Info("Creating topic if not already existing")
 			topicConfig := make(map[string]string)
 			if c.TopicSettings.Config != nil {
@@ -0,0 +1,185 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+func testEntities(ids ...string) []*coder.Entity {
+	entities := make([]*coder.Entity, len(ids))
+	for i, id := range ids {
+		entities[i] = coder.NewEntity()
+		entities[i].ID = id
+	}
+	return entities
+}
+
+// written returns the ids of the committed entities on the topic.
+func written(t *testing.T, env *conf.Env, topic string) map[string]bool {
+	t.Helper()
+	ids := make(map[string]bool)
+	for p := int32(0); p < 2; p++ {
+		for _, m := range readAll(t, env, topic, p) {
+			ids[string(m.Key)] = true
+		}
+	}
+	return ids
+}
+
+func TestBatch(t *testing.T) {
+	_, env := mockCluster(t, "people", "pets")
+	key := "id"
+	customerKey := "props:ns0:customerId"
+	configs := []conf.ProducerConfig{
+		{Dataset: "people", Topic: "people", Key: &key, BatchTimeout: "10ms"},
+		{Dataset: "pets", Topic: "pets", Key: &key, Transactional: true, TransactionTimeout: "30s"},
+		{Dataset: "orders", Topic: "people", Key: &customerKey},
+	}
+	producers := testProducers(env, configs...)
+	t.Cleanup(func() {
+		producers.writers.closeAll()
+		_ = producers.closeTransactions(context.Background())
+	})
+	ctx := &coder.Context{}
+
+	t.Run("rejects unknown datasets", func(t *testing.T) {
+		if _, err := producers.Begin(context.Background(), "cars", nil); !errors.Is(err, ErrDatasetNotFound) {
+			t.Errorf("expected ErrDatasetNotFound, got %v", err)
+		}
+	})
+	t.Run("writes batches", func(t *testing.T) {
+		batch, err := producers.Begin(context.Background(), "people", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Produce(ctx, testEntities("bob", "alice")); err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		batch.Abort()
+		if err = batch.Commit(); err == nil {
+			t.Error("expected an error when committing a batch twice")
+		}
+		if ids := written(t, env, "people"); len(ids) != 2 || !ids["bob"] || !ids["alice"] {
+			t.Errorf("expected bob and alice to be written, got %v", ids)
+		}
+	})
+	t.Run("rejects entities it cannot encode", func(t *testing.T) {
+		batch, err := producers.Begin(context.Background(), "orders", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer batch.Abort()
+		if err = batch.Produce(ctx, testEntities("order-1")); !errors.Is(err, ErrEncoding) || !errors.Is(err, coder.ErrKeyMissing) {
+			t.Errorf("expected an encoding error for the missing key, got %v", err)
+		}
+	})
+	t.Run("commits and aborts transactions", func(t *testing.T) {
+		batch, err := producers.Begin(context.Background(), "pets", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Produce(ctx, testEntities("cat")); err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		batch, err = producers.Begin(context.Background(), "pets", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Produce(ctx, testEntities("dog")); err != nil {
+			t.Fatal(err)
+		}
+		batch.Abort()
+		if err = batch.Commit(); err == nil {
+			t.Error("expected an error when committing an aborted batch")
+		}
+
+		// the mock cluster does not hide aborted messages from read_committed consumers, so this checks that the
+		// producer is ready for the next transaction
+		batch, err = producers.Begin(context.Background(), "pets", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Produce(ctx, testEntities("horse")); err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if ids := written(t, env, "pets"); !ids["cat"] || !ids["horse"] {
+			t.Errorf("expected the committed cat and horse, got %v", ids)
+		}
+	})
+	t.Run("gives up waiting for the running transaction", func(t *testing.T) {
+		batch, err := producers.Begin(context.Background(), "pets", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timeout := producers.transactions["pets"].timeout; timeout != 30*time.Second {
+			t.Errorf("expected the configured transaction timeout, got %v", timeout)
+		}
+
+		waiting, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err = producers.Begin(waiting, "pets", nil); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected to give up when the request ends, got %v", err)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		next, err := producers.Begin(context.Background(), "pets", nil)
+		if err != nil {
+			t.Fatalf("expected the next batch to get the producer, got %v", err)
+		}
+		next.Abort()
+	})
+	t.Run("closes transactional producers after running batches", func(t *testing.T) {
+		batch, err := producers.Begin(context.Background(), "pets", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = batch.Produce(ctx, testEntities("fish")); err != nil {
+			t.Fatal(err)
+		}
+
+		timeout, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err = producers.closeTransactions(timeout); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected to give up waiting for the running batch, got %v", err)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatalf("expected the producer to be usable until the batch ends, got %v", err)
+		}
+		if err = producers.closeTransactions(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if producers.transactions["pets"].producer != nil {
+			t.Error("expected the producer to be closed")
+		}
+		if ids := written(t, env, "pets"); !ids["fish"] {
+			t.Errorf("expected fish to be committed, got %v", ids)
+		}
+	})
+	t.Run("rejects batches when shutting down", func(t *testing.T) {
+		producers.lock.Lock()
+		producers.closing = true
+		producers.lock.Unlock()
+		if _, err := producers.Begin(context.Background(), "people", nil); !errors.Is(err, ErrShuttingDown) {
+			t.Errorf("expected ErrShuttingDown, got %v", err)
+		}
+		if err := wait(context.Background(), &producers.writes); err != nil {
+			t.Errorf("expected all batches to be done, got %v", err)
+		}
+	})
+}
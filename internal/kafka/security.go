@@ -0,0 +1,109 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	kgo "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// clientConfig returns the librdkafka configuration shared by all admin, consumer and producer clients,
+// extended with the given client specific settings.
+func clientConfig(env *conf.Env, settings kafka.ConfigMap) *kafka.ConfigMap {
+	config := kafka.ConfigMap{
+		"bootstrap.servers": strings.Join(env.KafkaBrokers, ","),
+	}
+	if security := env.KafkaSecurity; security != nil && security.Protocol != "" {
+		config["security.protocol"] = security.Protocol
+		if security.UsesSASL() {
+			config["sasl.mechanisms"] = security.SaslMechanism
+			config["sasl.username"] = security.SaslUsername
+			config["sasl.password"] = security.SaslPassword
+		}
+		if security.UsesTLS() {
+			if security.CaFile != "" {
+				config["ssl.ca.location"] = security.CaFile
+			}
+			if security.CertFile != "" {
+				config["ssl.certificate.location"] = security.CertFile
+			}
+			if security.KeyFile != "" {
+				config["ssl.key.location"] = security.KeyFile
+			}
+		}
+	}
+	for k, v := range settings {
+		config[k] = v
+	}
+	return &config
+}
+
+// newTransport returns the kafka-go transport used by producer writers, with the same security settings
+// as the librdkafka clients.
+func newTransport(env *conf.Env) (*kgo.Transport, error) {
+	transport := &kgo.Transport{}
+	security := env.KafkaSecurity
+	if security == nil {
+		return transport, nil
+	}
+	if security.UsesSASL() {
+		mechanism, err := saslMechanism(security)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+	if security.UsesTLS() {
+		tlsConfig, err := tlsConfig(security)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+	return transport, nil
+}
+
+func saslMechanism(security *conf.KafkaSecurityConfig) (sasl.Mechanism, error) {
+	switch security.SaslMechanism {
+	case "PLAIN":
+		return plain.Mechanism{Username: security.SaslUsername, Password: security.SaslPassword}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, security.SaslUsername, security.SaslPassword)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, security.SaslUsername, security.SaslPassword)
+	default:
+		return nil, fmt.Errorf("unsupported sasl mechanism %q", security.SaslMechanism)
+	}
+}
+
+func tlsConfig(security *conf.KafkaSecurityConfig) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if security.CaFile != "" {
+		ca, err := os.ReadFile(security.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", security.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if security.CertFile != "" || security.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(security.CertFile, security.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
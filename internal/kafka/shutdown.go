@@ -0,0 +1,25 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrShuttingDown is returned for reads and writes that are started after shutdown has begun.
+var ErrShuttingDown = errors.New("the datalayer is shutting down")
+
+// wait blocks until the wait group is done, or returns the context error if that happens first.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
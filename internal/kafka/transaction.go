@@ -0,0 +1,314 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	kgo "github.com/segmentio/kafka-go"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// Batch writes the entities of one request. For transactional datasets everything produced in the batch is
+// committed or aborted together, otherwise entities are written as they are produced.
+// Commit or Abort must be called to end the batch, Abort is a no-op after Commit.
+type Batch struct {
+	producers *Producers
+	config    *conf.ProducerConfig
+	tx        *txProducer
+	sync      *FullSync
+	session   *syncSession
+	done      bool
+}
+
+// txProducer is the transactional producer of a dataset. A producer can only run one transaction at a time,
+// so the lock is held from the beginning to the end of a transaction. The lock is a channel, so batches can give
+// up waiting for it.
+type txProducer struct {
+	transactionalId string
+	timeout         time.Duration
+	lock            chan struct{}
+	producer        *kafka.Producer
+}
+
+func newTxProducer(transactionalId string, timeout time.Duration) *txProducer {
+	return &txProducer{transactionalId: transactionalId, timeout: timeout, lock: make(chan struct{}, 1)}
+}
+
+// acquire takes the lock of the producer, or returns the ctx error if ctx ends first.
+func (tx *txProducer) acquire(ctx context.Context) error {
+	select {
+	case tx.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (tx *txProducer) release() {
+	<-tx.lock
+}
+
+// Begin starts a batch for the dataset, as part of a full sync if sync is not nil. It fails with ErrShuttingDown
+// once shutdown has begun, with ErrDatasetNotFound if the dataset is not configured, and with ErrUnknownFullSync
+// if the batch continues a full sync that is not running. Batches of transactional datasets wait for the running
+// transaction to end, or return the ctx error if ctx ends first.
+func (producers *Producers) Begin(ctx context.Context, datasetName string, sync *FullSync) (*Batch, error) {
+	config := producers.configForDataset(datasetName)
+	if config == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDatasetNotFound, datasetName)
+	}
+
+	producers.lock.Lock()
+	if producers.closing {
+		producers.lock.Unlock()
+		return nil, ErrShuttingDown
+	}
+	producers.writes.Add(1)
+	var tx *txProducer
+	if config.Transactional {
+		id, timeout := producers.transactionalId(config), transactionTimeout(config)
+		tx = producers.transactions[config.Dataset]
+		if tx == nil || tx.transactionalId != id || tx.timeout != timeout {
+			if tx != nil {
+				go producers.closeTransactional(tx)
+			}
+			tx = newTxProducer(id, timeout)
+			producers.transactions[config.Dataset] = tx
+		}
+	}
+	producers.lock.Unlock()
+
+	config, session, err := producers.prepareSync(config, sync)
+	if err != nil {
+		producers.writes.Done()
+		return nil, err
+	}
+
+	batch := &Batch{producers: producers, config: config, tx: tx, sync: sync, session: session}
+	if tx == nil {
+		return batch, nil
+	}
+
+	if err := tx.acquire(ctx); err != nil {
+		producers.writes.Done()
+		return nil, fmt.Errorf("gave up waiting for the running transaction of %s: %w", config.Dataset, err)
+	}
+	if err := producers.beginTransaction(tx); err != nil {
+		tx.release()
+		producers.writes.Done()
+		return nil, err
+	}
+	return batch, nil
+}
+
+func (producers *Producers) transactionalId(config *conf.ProducerConfig) string {
+	if config.TransactionalId != "" {
+		return config.TransactionalId
+	}
+	return fmt.Sprintf("%s-%s", producers.env.ServiceName, config.Dataset)
+}
+
+// transactionTimeout returns the configured transaction timeout, or 0 for the librdkafka default.
+func transactionTimeout(config *conf.ProducerConfig) time.Duration {
+	// configs are validated before they are used, so an invalid duration is not expected here
+	d, _ := time.ParseDuration(config.TransactionTimeout)
+	return d
+}
+
+// beginTransaction starts a transaction, creating the producer first if needed. Must be called with the tx lock.
+func (producers *Producers) beginTransaction(tx *txProducer) error {
+	if tx.producer == nil {
+		settings := kafka.ConfigMap{
+			"transactional.id":   tx.transactionalId,
+			"enable.idempotence": true,
+			// same partitioning as the non transactional writers, and the java producer
+			"partitioner": "murmur2_random",
+		}
+		if tx.timeout > 0 {
+			settings["transaction.timeout.ms"] = int(tx.timeout.Milliseconds())
+		}
+		p, err := kafka.NewProducer(clientConfig(producers.env, settings))
+		if err != nil {
+			return err
+		}
+		go drainEvents(p)
+		if err = p.InitTransactions(context.Background()); err != nil {
+			p.Close()
+			return fmt.Errorf("could not init transactions for %s: %w", tx.transactionalId, err)
+		}
+		tx.producer = p
+	}
+	if err := tx.producer.BeginTransaction(); err != nil {
+		producers.resetOnFatal(tx, err)
+		return err
+	}
+	return nil
+}
+
+// drainEvents consumes the events that are not delivery reports, librdkafka blocks if they are never read.
+func drainEvents(p *kafka.Producer) {
+	for range p.Events() {
+	}
+}
+
+// resetOnFatal closes the producer after fatal errors, such as being fenced by another instance with the same
+// transactional id. The next batch creates a new producer.
+func (producers *Producers) resetOnFatal(tx *txProducer, err error) {
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) && kafkaErr.IsFatal() {
+		producers.log.Warnf("Transactional producer %s failed, it is recreated for the next batch: %v", tx.transactionalId, err)
+		tx.producer.Close()
+		tx.producer = nil
+	}
+}
+
+// Produce writes the entities as part of the batch.
+func (batch *Batch) Produce(ctx *coder.Context, entities []*coder.Entity) error {
+	if batch.done {
+		return errors.New("batch is already done")
+	}
+	data, err := batch.producers.messages(batch.config, ctx, entities)
+	if err != nil {
+		return err
+	}
+	if batch.tx == nil {
+		err = batch.producers.write(batch.config, data)
+	} else {
+		err = batch.produceTransactional(data)
+	}
+	if err != nil {
+		return err
+	}
+	return batch.producers.trackKeys(batch.config, batch.session, data)
+}
+
+func (batch *Batch) produceTransactional(data []kgo.Message) error {
+	var err error
+	topic := batch.config.Topic
+	delivery := make(chan kafka.Event, len(data))
+	for _, m := range data {
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            m.Key,
+			Value:          m.Value,
+		}
+		for _, h := range m.Headers {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+		if err = batch.tx.producer.Produce(msg, delivery); err != nil {
+			return err
+		}
+	}
+	for range data {
+		e := <-delivery
+		if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			err = m.TopicPartition.Error
+		}
+	}
+	return err
+}
+
+// Commit ends the batch. For transactional datasets the transaction is committed, or aborted if that fails.
+// If the batch ends a full sync, the sync is completed after the commit.
+func (batch *Batch) Commit() error {
+	if batch.done {
+		return errors.New("batch is already done")
+	}
+
+	var err error
+	if batch.tx != nil {
+		err = batch.tx.producer.CommitTransaction(context.Background())
+		if err != nil {
+			// a failed commit leaves the transaction open, unless the producer can not be used anymore
+			batch.producers.resetOnFatal(batch.tx, err)
+			batch.abort()
+		}
+	}
+	if err == nil && batch.session != nil && batch.sync.End {
+		err = batch.producers.finishSync(batch.config, batch.session)
+	}
+	batch.end()
+	return err
+}
+
+// Abort ends the batch, and aborts the transaction of transactional datasets.
+func (batch *Batch) Abort() {
+	if batch.done {
+		return
+	}
+	if batch.tx != nil {
+		batch.abort()
+	}
+	batch.end()
+}
+
+func (batch *Batch) abort() {
+	if batch.tx.producer == nil {
+		return
+	}
+	if err := batch.tx.producer.AbortTransaction(context.Background()); err != nil {
+		batch.producers.log.Warnf("Could not abort transaction of %s: %v", batch.tx.transactionalId, err)
+		batch.producers.resetOnFatal(batch.tx, err)
+	}
+}
+
+func (batch *Batch) end() {
+	batch.done = true
+	if batch.tx != nil {
+		batch.tx.release()
+	}
+	batch.producers.writes.Done()
+}
+
+// retainTransactions closes the transactional producers of datasets that are removed, or that changed their
+// transactional id or timeout. Running transactions are allowed to finish first.
+func (producers *Producers) retainTransactions(configs []conf.ProducerConfig) {
+	current := make(map[string]*conf.ProducerConfig)
+	for i := range configs {
+		if configs[i].Transactional {
+			current[configs[i].Dataset] = &configs[i]
+		}
+	}
+
+	producers.lock.Lock()
+	defer producers.lock.Unlock()
+	for dataset, tx := range producers.transactions {
+		if c, ok := current[dataset]; ok && producers.transactionalId(c) == tx.transactionalId && transactionTimeout(c) == tx.timeout {
+			continue
+		}
+		delete(producers.transactions, dataset)
+		go producers.closeTransactional(tx)
+	}
+}
+
+// closeTransactions closes all transactional producers. A batch that is still running holds the lock of its
+// producer, so the producer is closed when the batch ends. It returns the ctx error if that is not waited for.
+func (producers *Producers) closeTransactions(ctx context.Context) error {
+	producers.lock.Lock()
+	closed := &sync.WaitGroup{}
+	for _, tx := range producers.transactions {
+		closed.Add(1)
+		go func(tx *txProducer) {
+			defer closed.Done()
+			producers.closeTransactional(tx)
+		}(tx)
+	}
+	producers.lock.Unlock()
+	return wait(ctx, closed)
+}
+
+func (producers *Producers) closeTransactional(tx *txProducer) {
+	_ = tx.acquire(context.Background())
+	defer tx.release()
+	if tx.producer != nil {
+		producers.log.Infof("Closing transactional producer %s", tx.transactionalId)
+		tx.producer.Close()
+		tx.producer = nil
+	}
+}
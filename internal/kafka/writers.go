@@ -0,0 +1,153 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	kgo "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+// writerKey identifies a writer by its dataset and the settings it was built with, so a config change that
+// affects the writer gives a new one.
+type writerKey struct {
+	dataset      string
+	topic        string
+	batchSize    int
+	batchTimeout time.Duration
+	requiredAcks kgo.RequiredAcks
+	compression  kgo.Compression
+	maxAttempts  int
+}
+
+type registeredWriter struct {
+	writer  *kgo.Writer
+	users   int
+	retired bool
+}
+
+// writerRegistry hands out shared writers per dataset. Writers that no longer match the config are retired,
+// and closed as soon as the last running write is done with them.
+type writerRegistry struct {
+	log              *zap.SugaredLogger
+	bootstrapServers []string
+	transport        *kgo.Transport
+	lock             sync.Mutex
+	writers          map[writerKey]*registeredWriter
+}
+
+func newWriterRegistry(log *zap.SugaredLogger, bootstrapServers []string, transport *kgo.Transport) *writerRegistry {
+	return &writerRegistry{
+		log:              log,
+		bootstrapServers: bootstrapServers,
+		transport:        transport,
+		writers:          make(map[writerKey]*registeredWriter),
+	}
+}
+
+func newWriterKey(config *conf.ProducerConfig) (writerKey, error) {
+	key := writerKey{
+		dataset:     config.Dataset,
+		topic:       config.Topic,
+		batchSize:   config.BatchSize,
+		maxAttempts: config.MaxAttempts,
+	}
+	if config.BatchTimeout != "" {
+		d, err := time.ParseDuration(config.BatchTimeout)
+		if err != nil {
+			return key, fmt.Errorf("invalid batchTimeout for %s: %w", config.Dataset, err)
+		}
+		key.batchTimeout = d
+	}
+	if config.RequiredAcks != "" {
+		if err := key.requiredAcks.UnmarshalText([]byte(config.RequiredAcks)); err != nil {
+			return key, fmt.Errorf("invalid requiredAcks for %s: %w", config.Dataset, err)
+		}
+	}
+	if config.Compression != "" {
+		if err := key.compression.UnmarshalText([]byte(config.Compression)); err != nil {
+			return key, fmt.Errorf("invalid compression for %s: %w", config.Dataset, err)
+		}
+	}
+	return key, nil
+}
+
+// acquire returns the writer for the config. The release func must be called when the write is done.
+func (registry *writerRegistry) acquire(config *conf.ProducerConfig) (*kgo.Writer, func(), error) {
+	key, err := newWriterKey(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	entry, ok := registry.writers[key]
+	if !ok {
+		entry = &registeredWriter{writer: &kgo.Writer{
+			Addr:         kgo.TCP(registry.bootstrapServers...),
+			Topic:        key.topic,
+			Balancer:     kgo.Murmur2Balancer{},
+			Transport:    registry.transport,
+			BatchSize:    key.batchSize,
+			BatchTimeout: key.batchTimeout,
+			RequiredAcks: key.requiredAcks,
+			Compression:  key.compression,
+			MaxAttempts:  key.maxAttempts,
+		}}
+		registry.writers[key] = entry
+	}
+	entry.users++
+
+	return entry.writer, func() {
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		entry.users--
+		if entry.retired && entry.users == 0 {
+			registry.close(key, entry)
+		}
+	}, nil
+}
+
+// retain retires all writers that do not match one of the given configs.
+func (registry *writerRegistry) retain(configs []conf.ProducerConfig) {
+	current := make(map[writerKey]bool)
+	for i := range configs {
+		if key, err := newWriterKey(&configs[i]); err == nil {
+			current[key] = true
+		}
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for key, entry := range registry.writers {
+		if current[key] {
+			continue
+		}
+		delete(registry.writers, key)
+		entry.retired = true
+		if entry.users == 0 {
+			registry.close(key, entry)
+		}
+	}
+}
+
+// closeAll flushes and closes all writers, running writes should be done before this is called.
+func (registry *writerRegistry) closeAll() {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	for key, entry := range registry.writers {
+		delete(registry.writers, key)
+		entry.retired = true
+		registry.close(key, entry)
+	}
+}
+
+func (registry *writerRegistry) close(key writerKey, entry *registeredWriter) {
+	registry.log.Infof("Closing writer for %s on topic %s", key.dataset, key.topic)
+	if err := entry.writer.Close(); err != nil {
+		registry.log.Warnf("Could not close writer for %s: %v", key.dataset, err)
+	}
+}
@@ -0,0 +1,107 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	kgo "github.com/segmentio/kafka-go"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/conf"
+)
+
+func TestWriterRegistry(t *testing.T) {
+	_, env := mockCluster(t, "people")
+	registry := newWriterRegistry(env.Logger, env.KafkaBrokers, &kgo.Transport{})
+	t.Cleanup(registry.closeAll)
+	config := conf.ProducerConfig{Dataset: "people", Topic: "people", BatchTimeout: "10ms"}
+	changed := config
+	changed.BatchSize = 10
+	write := func(w *kgo.Writer) error {
+		return w.WriteMessages(context.Background(), kgo.Message{Key: []byte("a"), Value: []byte("{}")})
+	}
+
+	w1, release1, err := registry.acquire(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, release2, _ := registry.acquire(&config)
+	if w1 != w2 {
+		t.Error("expected writes with the same config to share the writer")
+	}
+	w3, release3, _ := registry.acquire(&changed)
+	if w3 == w1 {
+		t.Error("expected a new writer for changed writer settings")
+	}
+	release3()
+
+	// the first writer is retired, but stays open until its last write is done
+	registry.retain([]conf.ProducerConfig{changed})
+	release1()
+	if err = write(w2); err != nil {
+		t.Fatalf("expected the retired writer to be usable while it has users, got %v", err)
+	}
+	release2()
+	if err = write(w2); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected the retired writer to be closed on its last release, got %v", err)
+	}
+	w4, release4, _ := registry.acquire(&config)
+	if w4 == w1 {
+		t.Error("expected a new writer after the old one was retired")
+	}
+	release4()
+
+	// writers without users are closed as soon as they are retired
+	if err = write(w3); err != nil {
+		t.Fatalf("expected the current writer to be open, got %v", err)
+	}
+	registry.retain(nil)
+	if err = write(w3); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected an unused writer to be closed when retired, got %v", err)
+	}
+
+	config.RequiredAcks = "some"
+	if _, _, err = registry.acquire(&config); err == nil {
+		t.Error("expected an error for invalid writer settings")
+	}
+}
+
+func TestProducerConfigUpdates(t *testing.T) {
+	_, env := mockCluster(t)
+	producers := testProducers(env)
+	people := &conf.KafkaConfig{Producers: []conf.ProducerConfig{{Dataset: "people", Topic: "people"}}}
+	pets := &conf.KafkaConfig{Producers: []conf.ProducerConfig{{Dataset: "pets", Topic: "pets"}}}
+
+	producers.update(people)
+	if !producers.DoesDatasetExist("people") || producers.DoesDatasetExist("pets") {
+		t.Error("expected only people to exist")
+	}
+
+	// lookups run concurrently with config reloads
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			producers.update(pets)
+			producers.update(people)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if c := producers.configForDataset("people"); c != nil && c.Topic != "people" {
+			t.Errorf("expected the people config, got %v", c)
+		}
+	}
+	wg.Wait()
+
+	producers.update(pets)
+	if producers.DoesDatasetExist("people") || !producers.DoesDatasetExist("pets") {
+		t.Error("expected only pets to exist after the update")
+	}
+	producers.update(nil)
+	if producers.DoesDatasetExist("pets") {
+		t.Error("expected no datasets without config")
+	}
+}
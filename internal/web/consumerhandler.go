@@ -2,7 +2,7 @@ package web
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -16,7 +16,15 @@ import (
 
 type consumerHandler struct {
 	logger    *zap.SugaredLogger
-	consumers *kafka.Consumers
+	consumers changeSets
+}
+
+// changeSets is the part of kafka.Consumers used to serve reads.
+type changeSets interface {
+	Preflight(datasetName string) error
+	ConfigDigest(datasetName string) string
+	GetContext(datasetName string) map[string]interface{}
+	ChangeSet(request kafka.DatasetRequest, callBack func(*coder.Entity)) error
 }
 
 func NewConsumerHandler(lc fx.Lifecycle, e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware, consumers *kafka.Consumers) {
@@ -47,48 +55,49 @@ func (handler *consumerHandler) consume(c echo.Context) error {
 	}
 	since := c.QueryParam("since")
 
-	// check dataset exists
-	if !handler.consumers.DoesDatasetExist(datasetName) {
-		return c.NoContent(http.StatusNotFound)
+	// check that the read can start, while we still can respond with a proper status
+	if err := handler.consumers.Preflight(datasetName); err != nil {
+		switch {
+		case errors.Is(err, kafka.ErrShuttingDown):
+			return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+		case errors.Is(err, kafka.ErrDatasetNotFound):
+			return c.NoContent(http.StatusNotFound)
+		case errors.Is(err, kafka.ErrDatasetInvalid):
+			handler.logger.Warn(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		default:
+			handler.logger.Warn(err)
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		}
 	}
 
-	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	w := newEntityWriter(c)
+	c.Response().Header().Set(echo.HeaderContentType, w.contentType())
+	c.Response().Header().Set("X-Config-Digest", handler.consumers.ConfigDigest(datasetName))
 	c.Response().WriteHeader(http.StatusOK)
-	enc := json.NewEncoder(c.Response())
-
-	c.Response().Write([]byte("["))
 
 	// make and send context as the first object
-	ctx := handler.consumers.GetContext(datasetName)
-
-	_ = enc.Encode(ctx)
+	w.writeContext(handler.consumers.GetContext(datasetName))
 
 	request := kafka.DatasetRequest{
+		Context:     c.Request().Context(),
 		DatasetName: datasetName,
 		Since:       since,
 		Limit:       l,
 	}
 	err := handler.consumers.ChangeSet(request, func(entity *coder.Entity) {
 		if entity.ID == "@continuation" { // it is returned as a normal entity, and we need to flatten it to the token format
-			cont := map[string]interface{}{
-				"id":    "@continuation",
-				"token": entity.Properties["token"],
-			}
-			c.Response().Write([]byte(","))
-			_ = enc.Encode(cont)
-			c.Response().Flush()
+			w.writeContinuation(entity.Properties["token"])
 		} else {
-			c.Response().Write([]byte(","))
-			_ = enc.Encode(entity)
-			c.Response().Flush()
+			w.writeEntity(entity)
 		}
 	})
 
 	if err != nil {
 		handler.logger.Warn(err)
+		w.writeError(err)
 	}
 
-	c.Response().Write([]byte("]"))
-	c.Response().Flush()
+	w.close()
 	return nil
 }
@@ -0,0 +1,117 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/kafka"
+)
+
+// fakeChangeSets emits the entities, followed by the error or a continuation.
+type fakeChangeSets struct {
+	preflightErr error
+	entities     []*coder.Entity
+	err          error
+}
+
+func (f *fakeChangeSets) Preflight(string) error {
+	return f.preflightErr
+}
+
+func (f *fakeChangeSets) ConfigDigest(string) string {
+	return "digest"
+}
+
+func (f *fakeChangeSets) GetContext(string) map[string]interface{} {
+	return map[string]interface{}{"id": "@context"}
+}
+
+func (f *fakeChangeSets) ChangeSet(_ kafka.DatasetRequest, callBack func(*coder.Entity)) error {
+	for _, entity := range f.entities {
+		callBack(entity)
+	}
+	if f.err != nil {
+		return f.err
+	}
+	token := coder.NewEntity()
+	token.ID = "@continuation"
+	token.Properties["token"] = "eyIwIjoxfQ=="
+	callBack(token)
+	return nil
+}
+
+func serveConsume(consumers changeSets, accept string) *httptest.ResponseRecorder {
+	e := echo.New()
+	handler := &consumerHandler{logger: zap.NewNop().Sugar(), consumers: consumers}
+	e.GET("/datasets/:dataset/entities", handler.consume)
+
+	req := httptest.NewRequest(http.MethodGet, "/datasets/people/entities", nil)
+	if accept != "" {
+		req.Header.Set(echo.HeaderAccept, accept)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func testEntity(id string) *coder.Entity {
+	entity := coder.NewEntity()
+	entity.ID = id
+	entity.Properties["ns0:name"] = id
+	return entity
+}
+
+func TestConsumePreflight(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{kafka.ErrShuttingDown, http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: people", kafka.ErrDatasetNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: people: bad position", kafka.ErrDatasetInvalid), http.StatusInternalServerError},
+		{fmt.Errorf("%w: people", kafka.ErrTopicNotFound), http.StatusBadGateway},
+		{errors.New("could not read metadata"), http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		rec := serveConsume(&fakeChangeSets{preflightErr: c.err}, "")
+		if rec.Code != c.status {
+			t.Errorf("expected %d for %v, got %d", c.status, c.err, rec.Code)
+		}
+	}
+}
+
+func TestConsumeFailure(t *testing.T) {
+	consumers := &fakeChangeSets{
+		entities: []*coder.Entity{testEntity("ns0:bob")},
+		err:      errors.New("could not decode message"),
+	}
+	rec := serveConsume(consumers, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the stream to have started with 200, got %d", rec.Code)
+	}
+
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &objects); err != nil {
+		t.Fatalf("expected a json array, got %s: %v", rec.Body.String(), err)
+	}
+	if len(objects) != 3 {
+		t.Fatalf("expected context, entity and error, got %v", objects)
+	}
+	last := objects[len(objects)-1]
+	if last["id"] != "@error" || last["error"] != "could not decode message" {
+		t.Errorf("expected the stream to end with the error, got %v", last)
+	}
+	for _, o := range objects {
+		if o["id"] == "@continuation" {
+			t.Error("expected no continuation in a failed stream")
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package web
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+)
+
+const MIMEApplicationNDJSON = "application/x-ndjson"
+
+// entityWriter streams a consumer dataset to the client, one object at a time.
+type entityWriter interface {
+	contentType() string
+	writeContext(ctx map[string]interface{})
+	writeEntity(entity *coder.Entity)
+	writeContinuation(token interface{})
+	writeError(err error)
+	close()
+}
+
+// newEntityWriter picks the output format from the Accept header, a json array is the default.
+func newEntityWriter(c echo.Context) entityWriter {
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), MIMEApplicationNDJSON) {
+		return &ndjsonWriter{response: c.Response(), enc: json.NewEncoder(c.Response())}
+	}
+	return &jsonArrayWriter{response: c.Response(), enc: json.NewEncoder(c.Response())}
+}
+
+// jsonArrayWriter writes the UDA json array, with the context as the first object.
+type jsonArrayWriter struct {
+	response *echo.Response
+	enc      *json.Encoder
+}
+
+func (w *jsonArrayWriter) contentType() string {
+	return echo.MIMEApplicationJSON
+}
+
+func (w *jsonArrayWriter) writeContext(ctx map[string]interface{}) {
+	_, _ = w.response.Write([]byte("["))
+	_ = w.enc.Encode(ctx)
+}
+
+func (w *jsonArrayWriter) writeEntity(entity *coder.Entity) {
+	_, _ = w.response.Write([]byte(","))
+	_ = w.enc.Encode(entity)
+	w.response.Flush()
+}
+
+func (w *jsonArrayWriter) writeContinuation(token interface{}) {
+	_, _ = w.response.Write([]byte(","))
+	_ = w.enc.Encode(continuation(token))
+	w.response.Flush()
+}
+
+func (w *jsonArrayWriter) writeError(err error) {
+	_, _ = w.response.Write([]byte(","))
+	_ = w.enc.Encode(errorObject(err))
+}
+
+func (w *jsonArrayWriter) close() {
+	_, _ = w.response.Write([]byte("]"))
+	w.response.Flush()
+}
+
+// ndjsonWriter writes one object per line, starting with the context and ending with either a continuation
+// or an error object.
+type ndjsonWriter struct {
+	response *echo.Response
+	enc      *json.Encoder
+}
+
+func (w *ndjsonWriter) contentType() string {
+	return MIMEApplicationNDJSON
+}
+
+func (w *ndjsonWriter) writeContext(ctx map[string]interface{}) {
+	_ = w.enc.Encode(ctx)
+}
+
+func (w *ndjsonWriter) writeEntity(entity *coder.Entity) {
+	_ = w.enc.Encode(entity)
+	w.response.Flush()
+}
+
+func (w *ndjsonWriter) writeContinuation(token interface{}) {
+	_ = w.enc.Encode(continuation(token))
+	w.response.Flush()
+}
+
+func (w *ndjsonWriter) writeError(err error) {
+	_ = w.enc.Encode(errorObject(err))
+}
+
+func (w *ndjsonWriter) close() {
+	w.response.Flush()
+}
+
+// errorObject signals a failed read. It replaces the continuation, so the client knows the response is incomplete.
+func errorObject(err error) map[string]interface{} {
+	return map[string]interface{}{
+		"id":    "@error",
+		"error": err.Error(),
+	}
+}
+
+func continuation(token interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":    "@continuation",
+		"token": token,
+	}
+}
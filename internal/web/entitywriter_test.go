@@ -0,0 +1,58 @@
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/coder"
+)
+
+func TestEntityWriterFormats(t *testing.T) {
+	consumers := &fakeChangeSets{entities: []*coder.Entity{testEntity("ns0:bob"), testEntity("ns0:alice")}}
+
+	t.Run("ndjson", func(t *testing.T) {
+		rec := serveConsume(consumers, "application/json, "+MIMEApplicationNDJSON)
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != MIMEApplicationNDJSON {
+			t.Errorf("expected content type %s, got %s", MIMEApplicationNDJSON, ct)
+		}
+
+		ids := make([]interface{}, 0)
+		scanner := bufio.NewScanner(strings.NewReader(rec.Body.String()))
+		for scanner.Scan() {
+			var object map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &object); err != nil {
+				t.Fatalf("expected one json object per line, got %q: %v", scanner.Text(), err)
+			}
+			ids = append(ids, object["id"])
+		}
+		expected := []interface{}{"@context", "ns0:bob", "ns0:alice", "@continuation"}
+		if len(ids) != len(expected) {
+			t.Fatalf("expected the lines %v, got %v", expected, ids)
+		}
+		for i := range expected {
+			if ids[i] != expected[i] {
+				t.Errorf("expected line %d to be %v, got %v", i, expected[i], ids[i])
+			}
+		}
+		if !strings.HasSuffix(rec.Body.String(), "}\n") {
+			t.Error("expected the continuation line to end with a newline")
+		}
+	})
+	t.Run("json array by default", func(t *testing.T) {
+		rec := serveConsume(consumers, "")
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != echo.MIMEApplicationJSON {
+			t.Errorf("expected content type %s, got %s", echo.MIMEApplicationJSON, ct)
+		}
+		var objects []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &objects); err != nil {
+			t.Fatalf("expected a json array, got %s: %v", rec.Body.String(), err)
+		}
+		if len(objects) != 4 || objects[3]["id"] != "@continuation" {
+			t.Errorf("expected context, two entities and the continuation, got %v", objects)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 
@@ -39,6 +40,23 @@ func NewProducerHandler(lc fx.Lifecycle, e *echo.Echo, logger *zap.SugaredLogger
 func (ph *producerHandler) produce(c echo.Context) error {
 	datasetName, _ := url.QueryUnescape(c.Param("dataset"))
 
+	// the whole request is written in one batch, so transactional datasets commit or abort it as a whole
+	batch, err := ph.producers.Begin(c.Request().Context(), datasetName, fullSync(c.Request().Header))
+	if err != nil {
+		switch {
+		case errors.Is(err, kafka.ErrShuttingDown):
+			return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+		case errors.Is(err, kafka.ErrDatasetNotFound):
+			return c.NoContent(http.StatusNotFound)
+		case errors.Is(err, kafka.ErrUnknownFullSync):
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		default:
+			ph.log.Warn(err)
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		}
+	}
+	defer batch.Abort()
+
 	// parse it
 	batchSize := 10000
 	read := 0
@@ -48,7 +66,9 @@ func (ph *producerHandler) produce(c echo.Context) error {
 	isFirst := true
 	ctx := &coder.Context{}
 
-	err := coder.ParseStream(c.Request().Body, func(value *jstream.MetaValue) error {
+	// produce errors stop the parsing, and are kept apart from errors in the payload
+	var produceErr error
+	err = coder.ParseStream(c.Request().Body, func(value *jstream.MetaValue) error {
 		if isFirst {
 			ctx = coder.AsContext(value)
 			isFirst = false
@@ -59,9 +79,9 @@ func (ph *producerHandler) produce(c echo.Context) error {
 				read = 0
 
 				// do stuff with entities
-				err2 := ph.producers.ProduceEntities(datasetName, ctx, entities)
-				if err2 != nil {
-					return err2
+				produceErr = batch.Produce(ctx, entities)
+				if produceErr != nil {
+					return produceErr
 				}
 				entities = make([]*coder.Entity, 0)
 			}
@@ -69,19 +89,47 @@ func (ph *producerHandler) produce(c echo.Context) error {
 		return nil
 	})
 
+	if produceErr != nil {
+		return ph.produceError(produceErr)
+	}
 	if err != nil {
 		ph.log.Warn(err)
-		return echo.NewHTTPError(http.StatusBadRequest, errors.New("could not parse the json payload").Error())
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("could not parse the json payload: %v", err))
 	}
 
 	if read > 0 {
 		// do stuff with leftover entities
-		err = ph.producers.ProduceEntities(datasetName, ctx, entities)
-		if err != nil {
-			ph.log.Warn(err)
-			return echo.NewHTTPError(http.StatusBadRequest, errors.New("could not parse the json payload").Error())
+		if err = batch.Produce(ctx, entities); err != nil {
+			return ph.produceError(err)
 		}
 	}
 
+	if err = batch.Commit(); err != nil {
+		ph.log.Warn(err)
+		return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+	}
+
 	return c.NoContent(http.StatusOK)
 }
+
+// produceError responds with 400 to entities the dataset cannot encode, and with 502 if writing to kafka failed.
+func (ph *producerHandler) produceError(err error) error {
+	ph.log.Warn(err)
+	if errors.Is(err, kafka.ErrEncoding) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+}
+
+// fullSync reads the full sync headers of the universal data api, and returns nil for incremental requests.
+func fullSync(header http.Header) *kafka.FullSync {
+	id := header.Get("universal-data-api-full-sync-id")
+	if id == "" {
+		return nil
+	}
+	return &kafka.FullSync{
+		Id:    id,
+		Start: header.Get("universal-data-api-full-sync-start") == "true",
+		End:   header.Get("universal-data-api-full-sync-end") == "true",
+	}
+}
@@ -0,0 +1,34 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/mimiro.io/kafka-datalayer/kafka-datalayer/internal/kafka"
+)
+
+func TestProduceError(t *testing.T) {
+	ph := &producerHandler{log: zap.NewNop().Sugar()}
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w ns0:bob: %w", kafka.ErrEncoding, errors.New("missing field name")), http.StatusBadRequest},
+		{errors.New("could not write to kafka: broker not available"), http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		var httpErr *echo.HTTPError
+		if !errors.As(ph.produceError(c.err), &httpErr) || httpErr.Code != c.status {
+			t.Errorf("expected %d for %v, got %v", c.status, c.err, httpErr)
+			continue
+		}
+		if httpErr.Message != c.err.Error() {
+			t.Errorf("expected the error text in the response, got %v", httpErr.Message)
+		}
+	}
+}